@@ -404,11 +404,12 @@ func eptid(idpMd, spMd *goxml.Xp, values map[string][]string) string {
 		sp = spMd.Query1(nil, "@entityID")
 	}
 
-	uidhashbase := "uidhashbase" + config.EptidSalt
+	salt := runningState().config.EptidSalt
+	uidhashbase := "uidhashbase" + salt
 	uidhashbase += strconv.Itoa(len(idp)) + ":" + idp
 	uidhashbase += strconv.Itoa(len(sp)) + ":" + sp
 	uidhashbase += strconv.Itoa(len(epid)) + ":" + epid
-	uidhashbase += config.EptidSalt
+	uidhashbase += salt
 
 	hash := sha1.Sum([]byte(uidhashbase))
 	return "WAYF-DK-" + hex.EncodeToString(append(hash[:]))
@@ -0,0 +1,118 @@
+package wayfhybrid
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	// trustedProxies holds the parsed Conf.TrustedProxies - a []*net.IPNet. It is read outside the stateLock by the internal listener.
+	trustedProxies atomic.Value
+)
+
+// parseTrustedProxies parses Conf.TrustedProxies
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	return parseCIDRs("TrustedProxies", cidrs)
+}
+
+// parseCIDRs parses CIDRs - plain addresses are taken as a single host. name is used in the error.
+func parseCIDRs(name string, cidrs []string) (nets []*net.IPNet, err error) {
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	nets, _ := trustedProxies.Load().([]*net.IPNet)
+	return netsContain(nets, ip)
+}
+
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. If the peer is a trusted proxy the Forwarded - or if missing - the X-Forwarded-For chain
+// is walked from the right and the first address that is not a trusted proxy is used.
+// An address that can not be parsed stops the walk - the last trusted proxy is used then.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	chain := forwardedFor(r.Header.Values("Forwarded"))
+	if len(chain) == 0 {
+		for _, xff := range r.Header.Values("X-Forwarded-For") {
+			for _, addr := range strings.Split(xff, ",") {
+				chain = append(chain, strings.TrimSpace(addr))
+			}
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := net.ParseIP(stripPort(chain[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// forwardedFor returns the for= addresses from RFC 7239 Forwarded headers in order
+func forwardedFor(headers []string) (addrs []string) {
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					addrs = append(addrs, strings.Trim(kv[1], `"`))
+				}
+			}
+		}
+	}
+	return
+}
+
+// stripPort removes the port from 192.0.2.1:4711 and [2001:db8::1]:4711 and the brackets from [2001:db8::1]
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// remoteIP returns the resolved client address for r
+func remoteIP(r *http.Request) string {
+	if ip := logRecordFor(r).RemoteAddr; ip != "" {
+		return ip
+	}
+	return clientIP(r)
+}
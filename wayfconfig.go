@@ -0,0 +1,647 @@
+package wayfhybrid
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/wayf-dk/godiscoveryservice"
+	"github.com/wayf-dk/gosaml"
+	"github.com/wayf-dk/lmdq"
+)
+
+type (
+	configSource struct {
+		name, source, value string
+	}
+
+	// mddbConfig is a configured metadata set - name is used for reporting, hub is the HubEntityID for hub sets
+	mddbConfig struct {
+		host, name, Path, Table, hub string
+	}
+
+	// stateKey is the request context key for the hybridState a request is served with
+	stateKey struct{}
+
+	// hybridState - everything that is derived from the config and replaced as a whole when the config is reloaded
+	hybridState struct {
+		config                            Conf
+		sloInfoCookie, authnRequestCookie *cookieKeyRing
+		deployments                       map[string]*deployment
+		defaultDeployment                 *deployment
+		trustedProxies                    []*net.IPNet
+		limiters                          map[string]*routeLimiter
+		mux                               http.Handler
+	}
+)
+
+var (
+	// secretFields are masked when logging the config
+	secretFields = map[string]bool{
+		"EptidSalt":             true,
+		"SecureCookieHashKey":   true,
+		"CookieKeys":            true,
+		"AdminToken":            true,
+		"SaltForHashedEppn":     true,
+		"GoEleven.SlotPassword": true,
+	}
+
+	// legacyEnvNames are the names used before all fields could be overridden
+	legacyEnvNames = map[string]string{
+		"GoEleven.SlotPassword": "WAYF_SLOTPASSWORD",
+	}
+)
+
+// loadConfig reads the toml config file and applies the overrides from the environment
+func loadConfig(file string) (conf Conf, err error) {
+	tomlConfig, err := toml.LoadFile(file)
+	if err != nil {
+		return conf, fmt.Errorf("config file: %s", err)
+	}
+	if err = tomlConfig.Unmarshal(&conf); err != nil {
+		return
+	}
+	sources, err := overrideConfig(&conf)
+	if err != nil {
+		return
+	}
+	for _, s := range sources {
+		log.Printf("config: %s = %s (%s)\n", s.name, s.value, s.source)
+	}
+	return
+}
+
+// overrideConfig sets the fields in conf from the environment. The name of the environment variable is the
+// uppercased path to the field prefixed by WAYF_ - eg. WAYF_EPTIDSALT and WAYF_HUB_PATH for Hub.Path.
+// WAYF_<NAME>_FILE reads the value from a file - for secrets mounted into a container.
+// Precedence is: WAYF_<NAME>, WAYF_<NAME>_FILE, the toml config.
+// Slices of strings are comma separated, other slices and maps are JSON.
+// The returned sources tells where each field came from - with secret values masked.
+func overrideConfig(conf *Conf) (sources []configSource, err error) {
+	err = overrideFields(reflect.ValueOf(conf).Elem(), "", &sources)
+	return
+}
+
+func overrideFields(v reflect.Value, path string, sources *[]configSource) (err error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := path + t.Field(i).Name
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err = overrideFields(field, name+".", sources); err != nil {
+				return
+			}
+			continue
+		}
+		envvar := "WAYF_" + strings.ToUpper(strings.Replace(name, ".", "_", -1))
+		val, source, ok, err := lookupEnv(envvar)
+		if !ok && legacyEnvNames[name] != "" {
+			val, source, ok, err = lookupEnv(legacyEnvNames[name])
+		}
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err = setField(field, val); err != nil {
+				return fmt.Errorf("%s: %s", source, err)
+			}
+		} else {
+			source = "toml"
+		}
+		value := fmt.Sprint(field.Interface())
+		if secretFields[name] && value != "" {
+			value = "********"
+		}
+		*sources = append(*sources, configSource{name: name, source: source, value: value})
+	}
+	return
+}
+
+// lookupEnv looks for envvar and envvar_FILE in that order and returns the value and where it came from
+func lookupEnv(envvar string) (val, source string, ok bool, err error) {
+	if val, ok = os.LookupEnv(envvar); ok {
+		return val, "env " + envvar, true, nil
+	}
+	if file, ok := os.LookupEnv(envvar + "_FILE"); ok {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", "", false, fmt.Errorf("%s_FILE: %s", envvar, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), "file " + file, true, nil
+	}
+	return
+}
+
+// setField sets field to the value of val converted to the type of field
+func setField(field reflect.Value, val string) (err error) {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(val); err == nil {
+			field.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if field.Type() == reflect.TypeOf(time.Duration(0)) {
+			var d time.Duration
+			d, err = time.ParseDuration(val)
+			i = int64(d)
+		} else {
+			i, err = strconv.ParseInt(val, 10, 64)
+		}
+		if err == nil {
+			field.SetInt(i)
+		}
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String {
+			vals := []string{}
+			for _, v := range strings.Split(val, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					vals = append(vals, v)
+				}
+			}
+			field.Set(reflect.ValueOf(vals))
+			return
+		}
+		fallthrough
+	case reflect.Map:
+		ptr := reflect.New(field.Type())
+		if err = json.Unmarshal([]byte(val), ptr.Interface()); err == nil {
+			field.Set(ptr.Elem())
+		}
+	default:
+		err = fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return
+}
+
+// newHybridState builds and validates a complete hybridState for conf without touching the running one.
+// Metadata sets and rate limiters in old - the running state, nil at startup - that are unchanged are reused, the rest are made from scratch.
+func newHybridState(conf Conf, old *hybridState) (st *hybridState, err error) {
+	st = &hybridState{config: conf}
+	if old == nil {
+		old = &hybridState{}
+	}
+
+	if st.authnRequestCookie, err = newCookieKeyRing(conf, "authnrequest", authnRequestTTL); err != nil {
+		return nil, err
+	}
+	if st.sloInfoCookie, err = newCookieKeyRing(conf, "sloinfo", sloInfoTTL); err != nil {
+		return nil, err
+	}
+
+	if st.trustedProxies, err = parseTrustedProxies(conf.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	if st.limiters, err = newRateLimiters(conf, old.limiters); err != nil {
+		return nil, err
+	}
+
+	if st.defaultDeployment, st.deployments, err = newDeployments(conf, mdqsOf(old.defaultDeployment, old.deployments)); err != nil {
+		return nil, err
+	}
+
+	mux, err := newMux(conf, st.limiters)
+	if err != nil {
+		return nil, err
+	}
+	st.mux = withSecurityHeaders(conf, mux)
+	return
+}
+
+// newDeployments opens the metadata sets and makes the deployments for conf - the metadata sets in old are reused if they are for the same path, table and rev
+func newDeployments(conf Conf, old []*lmdq.MDQ) (def *deployment, hosts map[string]*deployment, err error) {
+	hosts = map[string]*deployment{}
+	opened := map[string]*lmdq.MDQ{}
+	for _, mdq := range old {
+		if mdq.Cache != nil { // Cache is only set by Open
+			opened[mdq.Path+"|"+mdq.Table+"|"+mdq.Rev] = mdq
+		}
+	}
+	used, fresh := map[string]*lmdq.MDQ{}, []*lmdq.MDQ{}
+	defer func() {
+		if err != nil { // nobody else knows about the sets opened here
+			closeMdqs(fresh)
+		}
+	}()
+	open := func(c mdConf, rev, short string) (mdq *lmdq.MDQ, err error) {
+		key := c.Path + "|" + c.Table + "|" + rev
+		if mdq = used[key]; mdq != nil {
+			return
+		}
+		if mdq = opened[key]; mdq == nil {
+			mdq = &lmdq.MDQ{Path: c.Path, Table: c.Table, Rev: rev, Short: short}
+			if err = mdq.Open(); err != nil {
+				return nil, fmt.Errorf("metadata %s: %s", short, err)
+			}
+			fresh = append(fresh, mdq)
+		}
+		used[key] = mdq
+		return
+	}
+
+	names, hcs := hostConfs(conf)
+	for _, name := range names {
+		hc := hcs[name]
+		d, err := newDeployment(hc, open)
+		if err != nil {
+			if name != "" {
+				err = fmt.Errorf("Hosts.%s: %s", name, err)
+			}
+			return nil, nil, err
+		}
+		if name == "" {
+			def = d
+			continue
+		}
+		for _, host := range []string{name, hostOf(hc.TestSP), hostOf(hc.TestSP2)} {
+			if host != "" {
+				hosts[host] = d
+			}
+		}
+	}
+	return
+}
+
+// install makes st the running state - waits for the requests in flight to finish
+func (st *hybridState) install() {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	config = st.config
+	gosaml.PostForm = st.defaultDeployment.tmpl // gosaml only knows about one template
+	authnRequestCookie = st.authnRequestCookie
+	_, gosaml.AuthnRequestCookie = authnRequestCookie.newest() // gosaml only knows about one key
+	sloInfoCookie = st.sloInfoCookie
+
+	deployments = st.deployments
+	defaultDeployment = st.defaultDeployment
+	hybridMux = st.mux
+	rateLimiters = st.limiters
+	trustedProxies.Store(st.trustedProxies)
+
+	godiscoveryservice.Config = godiscoveryservice.Conf{
+		DiscoMetaData: config.Discometadata,
+		SpMetaData:    config.Discospmetadata,
+	}
+
+	gosaml.Config = gosaml.Conf{
+		SamlSchema: config.SamlSchema,
+		CertPath:   config.CertPath,
+	}
+}
+
+// runningState returns the running hybridState - stateLock is only held while it is copied
+func runningState() *hybridState {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	return &hybridState{config: config, sloInfoCookie: sloInfoCookie, authnRequestCookie: authnRequestCookie,
+		deployments: deployments, defaultDeployment: defaultDeployment, limiters: rateLimiters, mux: hybridMux}
+}
+
+// stateFor returns the hybridState slashFix took for r - the request keeps using it even if the config is reloaded meanwhile.
+// Requests that did not come through slashFix get the running state.
+func stateFor(r *http.Request) *hybridState {
+	if st, ok := r.Context().Value(stateKey{}).(*hybridState); ok {
+		return st
+	}
+	return runningState()
+}
+
+// reloadConfig re-reads the config and swaps it in if it is valid - otherwise the running config is kept
+// The GoEleven settings, the listening interfaces, the server and TLS settings, the session store, the SLO fallback and the replay cache are only used at startup.
+func reloadConfig() (err error) {
+	metadataUpdateGuard <- 1 // no metadata updates while we replace the md sets
+	defer func() { <-metadataUpdateGuard }()
+	conf, err := loadConfig(configPath + "hybrid-config/hybrid-config.toml")
+	if err != nil {
+		return
+	}
+	if problems := checkConfig(conf); len(problems) > 0 {
+		return joinErrors(problems)
+	}
+	running := runningState()
+	current := mdqsOf(running.defaultDeployment, running.deployments)
+	st, err := newHybridState(conf, running)
+	if err != nil {
+		return
+	}
+	st.install()
+	kept := map[*lmdq.MDQ]bool{}
+	for _, mdq := range mdqsOf(st.defaultDeployment, st.deployments) {
+		kept[mdq] = true
+	}
+	replaced := []*lmdq.MDQ{}
+	for _, mdq := range current {
+		if !kept[mdq] {
+			replaced = append(replaced, mdq)
+		}
+	}
+	retireMdqs(replaced)
+	log.Println("reload: config reloaded")
+	return
+}
+
+// adminHandler only allows POST requests from clients with a certificate signed by AdminClientCA or with the AdminToken as bearer token.
+// The admin routes are used by API clients so errors are returned as JSON - not as the error page.
+func adminHandler(fn appHandler) http.Handler {
+	return adminMethodHandler(http.MethodPost, fn)
+}
+
+// adminReadHandler is adminHandler for the admin routes that only report - they take GET instead of POST. Without AdminIntf the admin
+// listener is on port 9000 of the front interface, so the reports need the admin credentials as well.
+func adminReadHandler(fn appHandler) http.Handler {
+	return adminMethodHandler(http.MethodGet, fn)
+}
+
+func adminMethodHandler(method string, fn appHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeAPIError(w, http.StatusMethodNotAllowed, apiError{Error: "method_not_allowed", Message: r.Method + " is not allowed - use " + method})
+			return
+		}
+		if !adminAuthorized(r) {
+			writeAPIError(w, http.StatusUnauthorized, apiError{Error: errorKinds[unauthorizedError].class, Message: "a client certificate or the admin token is needed"})
+			return
+		}
+		fn.serve(w, r, errorJSON)
+	})
+}
+
+// exactPath only lets h serve path - other paths that the pattern of h matches, eg. all of them for "/", are not found
+func exactPath(path string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			writeAPIError(w, http.StatusNotFound, apiError{Error: "not_found", Message: r.URL.Path + " is not an admin route"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func adminAuthorized(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	token := stateFor(r).config.AdminToken
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// reloadService is the admin endpoint for reloading the config
+func reloadService(w http.ResponseWriter, r *http.Request) (err error) {
+	if err = reloadConfig(); err != nil {
+		return
+	}
+	io.WriteString(w, "Reloaded")
+	return
+}
+
+// checkConfig returns all the problems in conf that can be found without opening the metadata
+func checkConfig(conf Conf) (problems []error) {
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, a...))
+	}
+
+	seen := map[string]string{}
+	for _, rt := range routes(conf) {
+		if rt.pattern == "" {
+			problem("route %s: empty pattern", rt.name)
+		} else if prev, ok := seen[rt.pattern]; ok {
+			problem("route %s: pattern %q is also used by %s", rt.name, rt.pattern, prev)
+		}
+		seen[rt.pattern] = rt.name
+	}
+
+	certsOK := true
+	for _, f := range []struct{ name, path string }{{"HTTPSCert", conf.HTTPSCert}, {"HTTPSKey", conf.HTTPSKey}} {
+		if _, err := os.Stat(f.path); err != nil {
+			problem("%s: %s", f.name, err)
+			certsOK = false
+		}
+	}
+	if certsOK {
+		if _, err := tls.LoadX509KeyPair(conf.HTTPSCert, conf.HTTPSKey); err != nil {
+			problem("HTTPSCert/HTTPSKey: %s", err)
+		}
+	}
+
+	names, hcs := hostConfs(conf)
+	for _, set := range mddbConfigs(names, hcs) {
+		if set.Table == "" {
+			problem("%s: empty table name", set.name)
+		}
+		if f, err := os.Open(mddbFile(set.Path)); err != nil {
+			problem("%s: %s", set.name, err)
+		} else {
+			f.Close()
+		}
+	}
+
+	if _, err := newTLSConfig(conf); err != nil {
+		problem("%s", err)
+	}
+
+	if conf.AdminClientCA != "" {
+		if pem, err := ioutil.ReadFile(conf.AdminClientCA); err != nil {
+			problem("AdminClientCA: %s", err)
+		} else if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			problem("AdminClientCA: no certificates found in %s", conf.AdminClientCA)
+		}
+	}
+
+	for _, name := range names {
+		if _, err := template.ParseFiles(hcs[name].Template); err != nil {
+			problem("%stemplates: %s", hostPrefix(name), err)
+		}
+	}
+
+	if _, err := newCookieKeyRing(conf, "", 0); err != nil {
+		problem("%s", err)
+	}
+
+	if _, err := parseTrustedProxies(conf.TrustedProxies); err != nil {
+		problem("%s", err)
+	}
+
+	if _, err := newRateLimiters(conf, nil); err != nil {
+		problem("%s", err)
+	}
+
+	if err := checkCORSOrigins(conf); err != nil {
+		problem("%s", err)
+	}
+
+	switch conf.SessionStore {
+	case "", "cookie", "memory":
+	case "sqlite":
+		if conf.SessionDB == "" {
+			problem("SessionDB: no path for the sqlite session store")
+		}
+	default:
+		problem("SessionStore: unknown store %q", conf.SessionStore)
+	}
+
+	switch conf.ReplayCache {
+	case "", "memory":
+	case "sqlite":
+		if conf.ReplayCacheDB == "" {
+			problem("ReplayCacheDB: no path for the sqlite replay cache")
+		}
+	default:
+		problem("ReplayCache: unknown cache %q", conf.ReplayCache)
+	}
+
+	switch conf.SLOFallback {
+	case "", "none", "memory":
+	case "sqlite":
+		if conf.SessionDB == "" {
+			problem("SessionDB: no path for the sqlite SLO fallback")
+		}
+	default:
+		problem("SLOFallback: unknown store %q", conf.SLOFallback)
+	}
+
+	if conf.HubSSOTTL < 0 {
+		problem("HubSSOTTL: %s is negative", conf.HubSSOTTL)
+	}
+
+	if conf.MetadataRefresh < 0 {
+		problem("MetadataRefresh: %s is negative", conf.MetadataRefresh)
+	}
+	feeds := map[string]bool{}
+	for _, feed := range conf.MetadataFeeds {
+		feeds[feed.Path] = true
+	}
+	for path, interval := range conf.MetadataRefreshIntervals {
+		if !feeds[path] {
+			problem("MetadataRefreshIntervals: %s is not a MetadataFeeds path", path)
+		} else if interval < 0 {
+			problem("MetadataRefreshIntervals: %s for %s is negative", interval, path)
+		}
+	}
+	if conf.MetadataGenerations < 0 {
+		problem("MetadataGenerations: %d is negative", conf.MetadataGenerations)
+	}
+	if conf.MetadataMaxSize < 0 {
+		problem("MetadataMaxSize: %d is negative", conf.MetadataMaxSize)
+	}
+	if conf.MetadataMaxEntityDrop < 0 || conf.MetadataMaxEntityDrop > 100 {
+		problem("MetadataMaxEntityDrop: %d is not a percentage", conf.MetadataMaxEntityDrop)
+	}
+	if conf.MetadataSigningKey != "" {
+		if _, err := loadPublicKey(conf.MetadataSigningKey); err != nil {
+			problem("MetadataSigningKey: %s", err)
+		}
+	} else if conf.MetadataManifestURL != "" {
+		problem("MetadataManifestURL: needs a MetadataSigningKey")
+	}
+	return
+}
+
+// checkMetadata opens the mddbs in conf - only the ones that exists to avoid that sqlite creates empty ones - and checks that HubEntityID resolves in the hub set.
+// The sets are closed again when the checks are done.
+func checkMetadata(conf Conf) (problems []error) {
+	opened := []*lmdq.MDQ{}
+	defer func() { closeMdqs(opened) }()
+	names, hcs := hostConfs(conf)
+	for _, set := range mddbConfigs(names, hcs) {
+		if _, err := os.Stat(mddbFile(set.Path)); err != nil {
+			continue // already reported by checkConfig
+		}
+		mdq := &lmdq.MDQ{Path: set.Path, Table: set.Table}
+		opened = append(opened, mdq)
+		if err := mdq.Open(); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %s", set.name, err))
+			continue
+		}
+		if set.hub != "" {
+			if _, err := mdq.MDQ(set.hub); err != nil {
+				problems = append(problems, fmt.Errorf("%sHubEntityID: %s not found in the Hub metadata", hostPrefix(set.host), set.hub))
+			}
+		}
+	}
+	return
+}
+
+// checkConfigCmd reports all problems found in conf and returns the exit status for the -checkconfig mode
+func checkConfigCmd(conf Conf, err error) int {
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	problems := append(checkConfig(conf), checkMetadata(conf)...)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Println("config OK")
+	return 0
+}
+
+// mddbConfigs returns the configured metadata sets for the named hostConfs with their names - hub is the HubEntityID for hub sets
+func mddbConfigs(names []string, hcs map[string]hostConf) (sets []mddbConfig) {
+	for _, name := range names {
+		hc, prefix := hcs[name], hostPrefix(name)
+		sets = append(sets,
+			mddbConfig{name, prefix + "Hub", hc.Hub.Path, hc.Hub.Table, hc.HubEntityID},
+			mddbConfig{name, prefix + "Internal", hc.Internal.Path, hc.Internal.Table, ""},
+			mddbConfig{name, prefix + "ExternalIDP", hc.ExternalIDP.Path, hc.ExternalIDP.Table, ""},
+			mddbConfig{name, prefix + "ExternalSP", hc.ExternalSP.Path, hc.ExternalSP.Table, ""},
+		)
+	}
+	return
+}
+
+// hostPrefix returns the prefix used for reporting problems in Conf.Hosts
+func hostPrefix(host string) string {
+	if host == "" {
+		return ""
+	}
+	return "Hosts." + host + "."
+}
+
+// hostOf returns the host part of a route pattern like wayfsp.wayf.dk/ - patterns without a host gives ""
+func hostOf(pattern string) string {
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		pattern = pattern[:i]
+	}
+	return pattern
+}
+
+// mddbFile returns the filename part of a sqlite path which might be an uri ie. file:name.mddb?mode=ro
+func mddbFile(path string) string {
+	path = strings.TrimPrefix(path, "file:")
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// joinErrors makes one error of a list of errors
+func joinErrors(errs []error) error {
+	msgs := []string{}
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
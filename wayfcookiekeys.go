@@ -0,0 +1,149 @@
+package wayfhybrid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/wayf-dk/gosaml"
+	"github.com/wayf-dk/goxml"
+)
+
+type (
+	// cookieKeyRing signs new cookies with the newest key - prefixed with the id of the key - and accepts cookies signed with any of the keys
+	cookieKeyRing struct {
+		name string
+		ids  []string
+		keys map[string]*gosaml.Hm // the legacy SecureCookieHashKey has the id "" - cookies signed with it has no id prefix
+	}
+)
+
+const (
+	// signedCookieHeader is the length of the hmac and the timestamp gosaml puts before the message - gosaml panics on shorter cookies
+	signedCookieHeader = 24
+)
+
+var (
+	cookieKeyID = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+	cookieKeyUse = newCounterVec("wayf_cookie_key_use_total", "Decoded cookies by cookie type and signing key id - legacy is the SecureCookieHashKey", "cookie", "key")
+)
+
+// newCookieKeyRing makes a key ring from the CookieKeys - the last one is the newest - and the legacy SecureCookieHashKey.
+// The SecureCookieHashKey is only used for signing if there are no CookieKeys.
+func newCookieKeyRing(conf Conf, name string, ttl int64) (kr *cookieKeyRing, err error) {
+	kr = &cookieKeyRing{name: name, keys: map[string]*gosaml.Hm{}}
+	if conf.SecureCookieHashKey != "" {
+		key, err := hex.DecodeString(conf.SecureCookieHashKey)
+		if err != nil || len(key) == 0 {
+			return nil, fmt.Errorf("SecureCookieHashKey: not a valid hex encoded key")
+		}
+		kr.ids = append(kr.ids, "")
+		kr.keys[""] = &gosaml.Hm{TTL: ttl, Hash: sha256.New, Key: key}
+	}
+	for _, ck := range conf.CookieKeys {
+		if !cookieKeyID.MatchString(ck.ID) {
+			return nil, fmt.Errorf("CookieKeys: invalid id '%s' - only letters, digits, _ and - allowed", ck.ID)
+		}
+		if _, ok := kr.keys[ck.ID]; ok {
+			return nil, fmt.Errorf("CookieKeys: duplicate id '%s'", ck.ID)
+		}
+		key, err := hex.DecodeString(ck.Key)
+		if err != nil || len(key) == 0 {
+			return nil, fmt.Errorf("CookieKeys: key '%s' is not a valid hex encoded key", ck.ID)
+		}
+		kr.ids = append(kr.ids, ck.ID)
+		kr.keys[ck.ID] = &gosaml.Hm{TTL: ttl, Hash: sha256.New, Key: key}
+	}
+	if len(kr.ids) == 0 {
+		return nil, fmt.Errorf("no CookieKeys or SecureCookieHashKey configured")
+	}
+	return
+}
+
+// newest returns the id and key used for signing
+func (kr *cookieKeyRing) newest() (id string, hm *gosaml.Hm) {
+	id = kr.ids[len(kr.ids)-1]
+	return id, kr.keys[id]
+}
+
+// Encode signs msg with the newest key
+func (kr *cookieKeyRing) Encode(id string, msg []byte) (str string, err error) {
+	keyID, hm := kr.newest()
+	if str, err = hm.Encode(id, msg); err != nil {
+		return
+	}
+	if keyID != "" {
+		str = keyID + "." + str
+	}
+	return
+}
+
+// Decode validates in with the key it was signed with
+func (kr *cookieKeyRing) Decode(id, in string) (msg []byte, err error) {
+	keyID := ""
+	if i := strings.Index(in, "."); i >= 0 {
+		keyID, in = in[:i], in[i+1:]
+	}
+	hm, ok := kr.keys[keyID]
+	if !ok {
+		return nil, goxml.NewWerror("cookie signed with unknown key", "key:"+keyID)
+	}
+	if signedMsg, _ := base64.RawURLEncoding.DecodeString(in); len(signedMsg) < signedCookieHeader {
+		return nil, goxml.NewWerror("cookie too short")
+	}
+	if msg, err = hm.Decode(id, in); err != nil {
+		return
+	}
+	if keyID == "" {
+		keyID = "legacy"
+	}
+	cookieKeyUse.inc(kr.name, keyID)
+	return
+}
+
+// resign validates in - which has no key id prefix - with any of the keys and signs it again with the newest key.
+// gosaml only knows the newest key, so the relayState cookies it made before a rotation must be signed again before gosaml decodes them.
+// The cookie keeps its timestamp so it does not live longer than it would have with the old key.
+// in is returned as is if it is signed with the newest key or not with any of the keys - then gosaml will reject it.
+func (kr *cookieKeyRing) resign(id, in string) string {
+	signedMsg, _ := base64.RawURLEncoding.DecodeString(in)
+	if len(signedMsg) < signedCookieHeader {
+		return in
+	}
+	for i := len(kr.ids) - 1; i >= 0; i-- {
+		msg, err := kr.keys[kr.ids[i]].Decode(id, in)
+		if err != nil {
+			continue
+		}
+		keyID := kr.ids[i]
+		if keyID == "" {
+			keyID = "legacy"
+		}
+		cookieKeyUse.inc(kr.name, keyID)
+		if i == len(kr.ids)-1 {
+			return in
+		}
+		_, hm := kr.newest()
+		return signAt(hm, id, msg, signedMsg[20:signedCookieHeader])
+	}
+	return in
+}
+
+// signAt signs msg with hm as hm.Encode does, but with the timestamp ts instead of now. gosaml has no way to do that.
+// The format is gosaml's: 0xc4 0x10, the first 16 bytes of the hmac of id, ts and msg, 0xd6 0xff, ts and msg.
+func signAt(hm *gosaml.Hm, id string, msg, ts []byte) string {
+	mac := hmac.New(hm.Hash, hm.Key)
+	mac.Write([]byte(id))
+	mac.Write(ts)
+	mac.Write(msg)
+	signedMsg := append([]byte{0xc4, 0x10}, mac.Sum(nil)[:16]...)
+	signedMsg = append(signedMsg, 0xd6, 0xff)
+	signedMsg = append(signedMsg, ts...)
+	signedMsg = append(signedMsg, msg...)
+	return base64.RawURLEncoding.EncodeToString(signedMsg)
+}
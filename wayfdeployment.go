@@ -0,0 +1,182 @@
+package wayfhybrid
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/wayf-dk/gosaml"
+	"github.com/wayf-dk/lmdq"
+)
+
+type (
+	// hostConf - the settings that can be set per host in Conf.Hosts - empty settings are taken from the top level config.
+	// TestSP and TestSP2 are not inherited - they are extra test SP hosts for the deployment.
+	hostConf struct {
+		Domain, HubEntityID, DiscoveryService, Template string
+		TestSP, TestSP2                                 string
+		Hub, Internal, ExternalIDP, ExternalSP          mdConf
+	}
+
+	mdConf struct {
+		Path, Table string
+	}
+
+	// deployment - a federation front door ie. the cookie domain, hub, discovery, templates and metadata sets used for a host
+	deployment struct {
+		Domain, HubEntityID, DiscoveryService    string
+		tmpl                                     *template.Template
+		md                                       mdSets
+		mdq                                      countingMdSets // md with lookups counted
+		intExtSP, intExtIDP, hubExtIDP, hubExtSP gosaml.MdSets
+		webMdMap                                 map[string]webMd
+	}
+
+	countingMdSets struct {
+		Hub, Internal, ExternalIDP, ExternalSP countingMd
+	}
+
+	// mdqOpener returns an opened MDQ - the same one for the same path, table and rev
+	mdqOpener func(c mdConf, rev, short string) (*lmdq.MDQ, error)
+)
+
+// resolve returns hc with the empty settings taken from conf
+func (hc hostConf) resolve(conf Conf) hostConf {
+	pick := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+	pick(&hc.Domain, conf.Domain)
+	pick(&hc.HubEntityID, conf.HubEntityID)
+	pick(&hc.DiscoveryService, conf.DiscoveryService)
+	pick(&hc.Template, configPath+"hybrid-config/templates/hybrid.tmpl")
+	for _, set := range []struct {
+		hc   *mdConf
+		conf mdConf
+	}{{&hc.Hub, conf.Hub}, {&hc.Internal, conf.Internal}, {&hc.ExternalIDP, conf.ExternalIDP}, {&hc.ExternalSP, conf.ExternalSP}} {
+		pick(&set.hc.Path, set.conf.Path)
+		pick(&set.hc.Table, set.conf.Table)
+	}
+	return hc
+}
+
+// hostConfs returns the resolved default hostConf - with the name "" - and the resolved Conf.Hosts sorted by name
+func hostConfs(conf Conf) (names []string, hcs map[string]hostConf) {
+	hcs = map[string]hostConf{"": hostConf{}.resolve(conf)}
+	for name, hc := range conf.Hosts {
+		hcs[name] = hc.resolve(conf)
+	}
+	for name := range hcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// newDeployment opens the metadata sets and parses the template for hc and checks that the HubEntityID resolves
+func newDeployment(hc hostConf, open mdqOpener) (d *deployment, err error) {
+	d = &deployment{Domain: hc.Domain, HubEntityID: hc.HubEntityID, DiscoveryService: hc.DiscoveryService}
+	if d.tmpl, err = template.ParseFiles(hc.Template); err != nil {
+		return nil, fmt.Errorf("templates: %s", err)
+	}
+	if d.md.Hub, err = open(hc.Hub, hc.Hub.Table, "hub"); err != nil {
+		return nil, err
+	}
+	if d.md.Internal, err = open(hc.Internal, hc.Internal.Table, "int"); err != nil {
+		return nil, err
+	}
+	if d.md.ExternalIDP, err = open(hc.ExternalIDP, hc.ExternalSP.Table, "idp"); err != nil {
+		return nil, err
+	}
+	if d.md.ExternalSP, err = open(hc.ExternalSP, hc.ExternalIDP.Table, "sp"); err != nil {
+		return nil, err
+	}
+	if err = d.useMdqs(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// withMdqs returns a copy of d that uses the metadata sets in sets instead of the ones they replace - the settings and the parsed template are shared with d
+func (d *deployment) withMdqs(sets map[*lmdq.MDQ]*lmdq.MDQ) (*deployment, error) {
+	c := *d
+	for _, mdq := range []**lmdq.MDQ{&c.md.Hub, &c.md.Internal, &c.md.ExternalIDP, &c.md.ExternalSP} {
+		if set, ok := sets[*mdq]; ok {
+			*mdq = set
+		}
+	}
+	if err := c.useMdqs(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// useMdqs checks that the HubEntityID resolves in d.md.Hub and makes the lookup sets of d from d.md
+func (d *deployment) useMdqs() error {
+	if _, err := d.md.Hub.MDQ(d.HubEntityID); err != nil {
+		return fmt.Errorf("HubEntityID: %s not found in hub metadata", d.HubEntityID)
+	}
+
+	d.mdq = countingMdSets{countingMd{d.md.Hub}, countingMd{d.md.Internal}, countingMd{d.md.ExternalIDP}, countingMd{d.md.ExternalSP}}
+	d.intExtSP = gosaml.MdSets{d.mdq.Internal, d.mdq.ExternalSP}
+	d.intExtIDP = gosaml.MdSets{d.mdq.Internal, d.mdq.ExternalIDP}
+	d.hubExtIDP = gosaml.MdSets{d.mdq.Hub, d.mdq.ExternalIDP}
+	d.hubExtSP = gosaml.MdSets{d.mdq.Hub, d.mdq.ExternalSP}
+
+	d.webMdMap = make(map[string]webMd)
+	mdqs := []*lmdq.MDQ{d.md.Hub, d.md.Internal, d.md.ExternalIDP, d.md.ExternalSP}
+	for _, mdq := range mdqs {
+		d.webMdMap[mdq.Table] = webMd{md: mdq}
+	}
+	for _, mdq := range mdqs {
+		m := webMd{md: mdq, revmd: d.webMdMap[mdq.Rev].md}
+		d.webMdMap[mdq.Table] = m
+		d.webMdMap[mdq.Short] = m
+	}
+	return nil
+}
+
+// deploymentFor returns the deployment for the host the request was sent to - the default one if there is no specific one
+func deploymentFor(r *http.Request) *deployment {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	st := stateFor(r)
+	if d, ok := st.deployments[host]; ok {
+		return d
+	}
+	return st.defaultDeployment
+}
+
+// allMdqs returns all the opened metadata sets used by the running deployments - stateLock must be held
+func allMdqs() []*lmdq.MDQ {
+	return mdqsOf(defaultDeployment, deployments)
+}
+
+// mdqsOf returns the metadata sets used by def and hosts - each only once
+func mdqsOf(def *deployment, hosts map[string]*deployment) (mdqs []*lmdq.MDQ) {
+	seen := map[*lmdq.MDQ]bool{}
+	for _, d := range append([]*deployment{def}, deploymentList(hosts)...) {
+		if d == nil {
+			continue
+		}
+		for _, mdq := range []*lmdq.MDQ{d.md.Hub, d.md.Internal, d.md.ExternalIDP, d.md.ExternalSP} {
+			if !seen[mdq] {
+				seen[mdq] = true
+				mdqs = append(mdqs, mdq)
+			}
+		}
+	}
+	return
+}
+
+func deploymentList(m map[string]*deployment) (ds []*deployment) {
+	for _, d := range m {
+		ds = append(ds, d)
+	}
+	return
+}
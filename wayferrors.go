@@ -0,0 +1,277 @@
+package wayfhybrid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/wayf-dk/gosaml"
+	"github.com/wayf-dk/goxml"
+	"github.com/wayf-dk/lmdq"
+)
+
+type (
+	errorKind int
+
+	// hybridError - an error with a kind that decides the http status and the message on the error page
+	hybridError struct {
+		kind errorKind
+		err  error
+	}
+
+	// contact - the display name and support contact of an SP or IdP for the error page
+	contact struct {
+		EntityID, DisplayName, Email string
+	}
+
+	// apiError - the JSON error body for the admin API clients
+	apiError struct {
+		Error     string `json:"error"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id,omitempty"`
+	}
+
+	// errorPageData - for the errorPage template
+	errorPageData struct {
+		Lang, Class, Title, Message, Reference string
+		Status                                 int
+		SP, IdP                                *contact
+	}
+)
+
+const (
+	internalError errorKind = iota
+	badRequestError
+	signatureError
+	unknownEntityError
+	noCommonFederationsError
+	expiredError
+	scopeError
+	unauthorizedError
+	rateLimitedError
+	replayError
+)
+
+var (
+	errorKinds = map[errorKind]struct {
+		class  string
+		status int
+	}{
+		internalError:            {"internal", http.StatusInternalServerError},
+		badRequestError:          {"bad_request", http.StatusBadRequest},
+		signatureError:           {"signature", http.StatusForbidden},
+		unknownEntityError:       {"unknown_entity", http.StatusBadRequest},
+		noCommonFederationsError: {"no_common_federations", http.StatusForbidden},
+		expiredError:             {"expired", http.StatusBadRequest},
+		scopeError:               {"scope", http.StatusForbidden},
+		unauthorizedError:        {"unauthorized", http.StatusUnauthorized},
+		rateLimitedError:         {"rate_limited", http.StatusTooManyRequests},
+		replayError:              {"replay", http.StatusBadRequest},
+	}
+
+	// samlStatuses - the top and second level status codes used in error Responses to the SP
+	samlStatuses = map[errorKind][2]string{
+		internalError:            {"urn:oasis:names:tc:SAML:2.0:status:Responder", ""},
+		noCommonFederationsError: {"urn:oasis:names:tc:SAML:2.0:status:Responder", "urn:oasis:names:tc:SAML:2.0:status:RequestDenied"},
+		scopeError:               {"urn:oasis:names:tc:SAML:2.0:status:Responder", "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"},
+		unknownEntityError:       {"urn:oasis:names:tc:SAML:2.0:status:Responder", "urn:oasis:names:tc:SAML:2.0:status:RequestDenied"},
+		signatureError:           {"urn:oasis:names:tc:SAML:2.0:status:Responder", "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"},
+		expiredError:             {"urn:oasis:names:tc:SAML:2.0:status:Responder", "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"},
+	}
+
+	// errorMessages - the texts for the error page by language and kind - the first line is the title
+	errorMessages = map[string]map[errorKind][2]string{
+		"en": {
+			internalError:            {"Internal error", "Something went wrong on our side. Please try again later."},
+			badRequestError:          {"Bad request", "The login request could not be understood. Please go back to the service and try again."},
+			signatureError:           {"Signature error", "The signature on the message could not be validated."},
+			unknownEntityError:       {"Unknown service", "The service or the identity provider is not known by WAYF."},
+			noCommonFederationsError: {"No common federation", "The service and the identity provider are not members of a common federation."},
+			expiredError:             {"Expired", "The login took too long or the clock on one of the systems is wrong. Please try again."},
+			scopeError:               {"Invalid attributes", "The identity provider sent attributes that it is not allowed to send."},
+			unauthorizedError:        {"Unauthorized", "You are not allowed to access this page."},
+			rateLimitedError:         {"Too many requests", "There are too many requests from you or the service. Please wait a moment and try again."},
+			replayError:              {"Login already used", "This login has already been used. Please go back to the service and log in again."},
+		},
+		"da": {
+			internalError:            {"Intern fejl", "Der skete en fejl hos os. Prøv venligst igen senere."},
+			badRequestError:          {"Ugyldig forespørgsel", "Login-forespørgslen kunne ikke forstås. Gå venligst tilbage til tjenesten og prøv igen."},
+			signatureError:           {"Signaturfejl", "Signaturen på beskeden kunne ikke valideres."},
+			unknownEntityError:       {"Ukendt tjeneste", "Tjenesten eller identitetsudbyderen er ikke kendt af WAYF."},
+			noCommonFederationsError: {"Ingen fælles føderation", "Tjenesten og identitetsudbyderen er ikke medlemmer af en fælles føderation."},
+			expiredError:             {"Udløbet", "Login tog for lang tid, eller uret på et af systemerne går forkert. Prøv venligst igen."},
+			scopeError:               {"Ugyldige attributter", "Identitetsudbyderen sendte attributter som den ikke må sende."},
+			unauthorizedError:        {"Ingen adgang", "Du har ikke adgang til denne side."},
+			rateLimitedError:         {"For mange forespørgsler", "Der er for mange forespørgsler fra dig eller tjenesten. Vent venligst lidt og prøv igen."},
+			replayError:              {"Login allerede brugt", "Dette login er allerede blevet brugt. Gå venligst tilbage til tjenesten og log ind igen."},
+		},
+	}
+
+	// defaultErrorPage is used if the template has no errorPage
+	defaultErrorPage = template.Must(template.New("errorPage").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}"><head><meta charset="utf-8"><title>WAYF - {{.Title}}</title></head>
+<body><h1>{{.Title}}</h1><p>{{.Message}}</p>
+{{with .SP}}<p>{{if eq $.Lang "da"}}Tjeneste{{else}}Service{{end}}: {{or .DisplayName .EntityID}}{{with .Email}} - <a href="mailto:{{.}}">{{.}}</a>{{end}}</p>{{end}}
+{{with .IdP}}<p>{{if eq $.Lang "da"}}Identitetsudbyder{{else}}Identity provider{{end}}: {{or .DisplayName .EntityID}}{{with .Email}} - <a href="mailto:{{.}}">{{.}}</a>{{end}}</p>{{end}}
+<p>{{if eq .Lang "da"}}Reference til support{{else}}Support reference{{end}}: <code>{{.Reference}}</code></p>
+</body></html>
+`))
+)
+
+func (e hybridError) Error() string {
+	return e.err.Error()
+}
+
+func (e hybridError) Unwrap() error {
+	return e.err
+}
+
+// newError makes err an error of the given kind
+func newError(kind errorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return hybridError{kind: kind, err: err}
+}
+
+// scopeErrorf makes a scopeError
+func scopeErrorf(format string, a ...interface{}) error {
+	return newError(scopeError, fmt.Errorf(format, a...))
+}
+
+// samlError gives err from receiving or checking a SAML message with gosaml a kind - gosaml only tells what the problem is
+// in the cause and the message text
+func samlError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return newError(gosamlKind(err), err)
+}
+
+// kindOf returns the kind of err - errors that are not made with newError are from outside and get the kind gosamlKind finds
+func kindOf(err error) errorKind {
+	var herr hybridError
+	if errors.As(err, &herr) {
+		return herr.kind
+	}
+	return gosamlKind(err)
+}
+
+// gosamlKind recognizes the errors from gosaml and lmdq by their cause and message text
+func gosamlKind(err error) errorKind {
+	msg := err.Error()
+	var x goxml.Werror
+	if errors.As(err, &x) {
+		switch x.Cause {
+		case nil:
+		case lmdq.MetaDataNotFoundError:
+			return unknownEntityError
+		case gosaml.ErrorACS:
+			return badRequestError
+		default:
+			if kind := kindOf(x.Cause); kind != internalError { // goxml.Wrap hides the kind in the cause
+				return kind
+			}
+		}
+		msg = x.FullError()
+	}
+	switch {
+	case strings.Contains(msg, "unable to validate signature"), strings.Contains(msg, "no signatures found"), strings.Contains(msg, "encryption error"):
+		return signatureError
+	case strings.Contains(msg, "timing problem"), strings.Contains(msg, "required timestamp"):
+		return expiredError
+	case strings.Contains(msg, "no SAMLRequest/SAMLResponse found"), strings.Contains(msg, "Destination is not valid"):
+		return badRequestError
+	}
+	return internalError
+}
+
+// errorStatus returns the http status for err
+func errorStatus(err error) int {
+	return errorKinds[kindOf(err)].status
+}
+
+// errorPage writes the localized error page for err - the template's errorPage is used if it has one.
+// Only the reference, not the error itself, is shown to the user.
+func errorPage(w http.ResponseWriter, r *http.Request, err error, rec *logRecord) {
+	kind := kindOf(err)
+	lang := preferredLang(r)
+	data := errorPageData{
+		Lang:      lang,
+		Class:     errorKinds[kind].class,
+		Title:     errorMessages[lang][kind][0],
+		Message:   errorMessages[lang][kind][1],
+		Reference: rec.RequestID,
+		Status:    errorKinds[kind].status,
+	}
+	if rec.Logtag != "" {
+		data.Reference = rec.Logtag + " " + rec.RequestID
+	}
+
+	tmpl := defaultErrorPage
+	if d := deploymentFor(r); d != nil {
+		if d.tmpl.Lookup("errorPage") != nil {
+			tmpl = d.tmpl
+		}
+		data.SP = contactFor(d.intExtSP, rec.SP, "md:SPSSODescriptor", lang)
+		data.IdP = contactFor(d.intExtIDP, rec.IdP, "md:IDPSSODescriptor", lang)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	setRetryAfter(w, err)
+	w.WriteHeader(data.Status)
+	tmpl.ExecuteTemplate(w, "errorPage", data)
+}
+
+// errorJSON writes err as JSON for the admin API clients - they are authenticated and get the error itself instead of the error page
+func errorJSON(w http.ResponseWriter, r *http.Request, err error, rec *logRecord) {
+	kind := kindOf(err)
+	setRetryAfter(w, err)
+	writeAPIError(w, errorKinds[kind].status, apiError{Error: errorKinds[kind].class, Message: err.Error(), RequestID: rec.RequestID})
+}
+
+// writeAPIError writes e with status
+func writeAPIError(w http.ResponseWriter, status int, e apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// contactFor returns the display name and support email for entityID - nil if there is no entityID
+func contactFor(mdSets gosaml.MdSets, entityID, role, lang string) *contact {
+	if entityID == "" {
+		return nil
+	}
+	c := &contact{EntityID: entityID}
+	md, _, err := gosaml.FindInMetadataSets(mdSets, entityID)
+	if err != nil {
+		return c
+	}
+	c.DisplayName = md.Query1(nil, role+`/md:Extensions/mdui:UIInfo/mdui:DisplayName[@xml:lang="`+lang+`"]`)
+	for _, contactType := range []string{"support", "technical", "administrative"} {
+		if c.Email = md.Query1(nil, `md:ContactPerson[@contactType="`+contactType+`"]/md:EmailAddress`); c.Email != "" {
+			c.Email = strings.TrimPrefix(c.Email, "mailto:")
+			break
+		}
+	}
+	return c
+}
+
+// preferredLang returns da if the browser prefers danish over english - otherwise en
+func preferredLang(r *http.Request) string {
+	for _, lang := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		lang = strings.ToLower(strings.TrimSpace(strings.SplitN(lang, ";", 2)[0]))
+		switch {
+		case strings.HasPrefix(lang, "da"):
+			return "da"
+		case strings.HasPrefix(lang, "en"):
+			return "en"
+		}
+	}
+	return "en"
+}
@@ -0,0 +1,250 @@
+package wayfhybrid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wayf-dk/goeleven/src/goeleven"
+	"github.com/wayf-dk/goxml"
+	"github.com/wayf-dk/lmdq"
+)
+
+type (
+	// healthReport - the JSON returned by the liveness and readiness endpoints
+	healthReport struct {
+		Status     string            `json:"status"`
+		Uptime     float64           `json:"uptime_seconds"`
+		Components []componentHealth `json:"components,omitempty"`
+	}
+
+	// componentHealth - the status of one component - only critical components affects readiness
+	componentHealth struct {
+		Name     string      `json:"name"`
+		OK       bool        `json:"ok"`
+		Critical bool        `json:"critical"`
+		Detail   string      `json:"detail,omitempty"`
+		Age      float64     `json:"age_seconds,omitempty"`
+		Feed     *feedStatus `json:"feed,omitempty"`
+	}
+)
+
+const (
+	hsmProbeTimeout = 2 * time.Second
+)
+
+var (
+	started = time.Now()
+
+	// hsmProbe - only one HSM probe runs at a time so a hanging HSM only ties up one goroutine
+	hsmProbe struct {
+		lock      sync.Mutex
+		done      chan struct{} // closed when the running probe returns - nil if no probe is running
+		start     time.Time     // when the running probe started
+		err       error         // the result of the last completed probe
+		completed bool
+	}
+	hsmCheck = goeleven.HSMStatus
+)
+
+// liveService reports that the process is alive - it does not check anything else
+func liveService(w http.ResponseWriter, r *http.Request) (err error) {
+	return writeHealth(w, healthReport{Status: "live"}, true)
+}
+
+// readyService reports if we are ready - the components are left out on the public listener
+func readyService(w http.ResponseWriter, r *http.Request) (err error) {
+	report, ready := readiness()
+	report.Components = nil
+	return writeHealth(w, report, ready)
+}
+
+// readyDetailsService reports the status of each component - not ready if any critical component fails. Only on the admin listener.
+func readyDetailsService(w http.ResponseWriter, r *http.Request) (err error) {
+	report, ready := readiness()
+	return writeHealth(w, report, ready)
+}
+
+// OkService is the old load balancer probe - it is the readiness without the details
+func OkService(w http.ResponseWriter, r *http.Request) (err error) {
+	if _, ready := readiness(); !ready {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+	}
+	return
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport, ok bool) error {
+	report.Uptime = time.Since(started).Seconds()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(report)
+}
+
+// readiness checks the components needed for serving logins
+func readiness() (report healthReport, ready bool) {
+	add := func(c componentHealth) {
+		report.Components = append(report.Components, c)
+	}
+	check := func(name string, critical bool, err error, detail string) {
+		c := componentHealth{Name: name, OK: err == nil, Critical: critical, Detail: detail}
+		if err != nil {
+			c.Detail = err.Error()
+		}
+		add(c)
+	}
+
+	check("serving", true, boolErr(isReady(), "draining"), "")
+
+	st := runningState()
+	for _, mdq := range mdqsOf(st.defaultDeployment, st.deployments) {
+		check("mddb:"+mdq.Short+":"+mdq.Table, true, mddbStatus(mdq), "")
+	}
+
+	hosts := []string{""}
+	for host := range st.deployments {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	seen := map[*deployment]bool{}
+	for _, host := range hosts {
+		d := st.defaultDeployment
+		if host != "" {
+			d = st.deployments[host]
+		}
+		if d == nil || seen[d] {
+			continue
+		}
+		seen[d] = true
+		name := host
+		if name == "" {
+			name = "default"
+		}
+		_, err := d.md.Hub.MDQ(d.HubEntityID)
+		check("hub:"+name, true, err, d.HubEntityID)
+		missing := []string{}
+		for _, t := range []string{"postForm", "attributeReleaseForm"} {
+			if d.tmpl == nil || d.tmpl.Lookup(t) == nil {
+				missing = append(missing, t)
+			}
+		}
+		check("templates:"+name, true, boolErr(len(missing) == 0, "missing "+strings.Join(missing, ", ")), "")
+	}
+
+	for _, feed := range st.config.MetadataFeeds {
+		c := componentHealth{Name: "feed:" + feed.Path, OK: true, Feed: feedStatusFor(feed.Path)}
+		if fi, err := os.Stat(feed.Path); err != nil {
+			c.OK, c.Detail = false, err.Error()
+		} else {
+			c.Age = time.Since(fi.ModTime()).Seconds()
+			if c.Feed != nil && c.Feed.Pinned != "" {
+				c.Detail = "pinned to " + c.Feed.Pinned
+			}
+		}
+		add(c)
+	}
+
+	if st.config.GoEleven.SlotPassword != "" {
+		check("hsm", true, hsmStatus(), fmt.Sprintf("maxsessions %s", st.config.GoEleven.Maxsessions))
+	} else {
+		check("hsm", false, nil, "not configured")
+	}
+
+	for _, ring := range []*cookieKeyRing{st.authnRequestCookie, st.sloInfoCookie} {
+		if ring == nil {
+			check("cookiekeys", true, errors.New("no cookie keys"), "")
+			continue
+		}
+		id, _ := ring.newest()
+		if id == "" {
+			id = "legacy"
+		}
+		check("cookiekeys:"+ring.name, true, nil, fmt.Sprintf("signing with %s, %d key(s)", id, len(ring.ids)))
+	}
+
+	ready = true
+	for _, c := range report.Components {
+		ready = ready && (c.OK || !c.Critical)
+	}
+	report.Status = "ready"
+	if !ready {
+		report.Status = "not ready"
+	}
+	return
+}
+
+// mddbStatus checks that mdq is open and can be queried - an unknown entity is fine, a database error is not
+func mddbStatus(mdq *lmdq.MDQ) (err error) {
+	if mdq.Cache == nil {
+		return errors.New("not open")
+	}
+	if _, err = mdq.MDQ("https://health.check.invalid"); err != nil {
+		var x goxml.Werror
+		if errors.As(err, &x) && x.Cause == lmdq.MetaDataNotFoundError {
+			return nil
+		}
+	}
+	return
+}
+
+// hsmStatus runs hsmCheck with a timeout. A caller that comes while a probe is running gets the result of the
+// last completed probe - or waits for the running one if there is none. Only a failed probe or a probe that has
+// been running for more than hsmProbeTimeout is an error.
+func hsmStatus() error {
+	hsmProbe.lock.Lock()
+	if hsmProbe.done != nil {
+		done, start, err, completed := hsmProbe.done, hsmProbe.start, hsmProbe.err, hsmProbe.completed
+		hsmProbe.lock.Unlock()
+		if time.Since(start) >= hsmProbeTimeout {
+			return errors.New("timeout")
+		}
+		if completed {
+			return err
+		}
+		return hsmWait(done, hsmProbeTimeout-time.Since(start))
+	}
+	done := make(chan struct{})
+	hsmProbe.done, hsmProbe.start = done, time.Now()
+	hsmProbe.lock.Unlock()
+	go func() {
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+			hsmProbe.lock.Lock()
+			hsmProbe.err, hsmProbe.completed, hsmProbe.done = err, true, nil
+			hsmProbe.lock.Unlock()
+			close(done)
+		}()
+		err = hsmCheck()
+	}()
+	return hsmWait(done, hsmProbeTimeout)
+}
+
+// hsmWait returns the result of the probe that closes done - or a timeout error if it takes longer than timeout
+func hsmWait(done chan struct{}, timeout time.Duration) error {
+	select {
+	case <-done:
+		hsmProbe.lock.Lock()
+		defer hsmProbe.lock.Unlock()
+		return hsmProbe.err
+	case <-time.After(timeout):
+		return errors.New("timeout")
+	}
+}
+
+func boolErr(ok bool, msg string) error {
+	if ok {
+		return nil
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,309 @@
+package wayfhybrid
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/wayf-dk/gosaml"
+	"github.com/wayf-dk/goxml"
+)
+
+type (
+	// hubSSOEntry - an IdP login the hub can reuse. The attributes are kept as the IdP sent them - they are canonicalized
+	// for each SP as some of them eg. eduPersonTargetedID depends on the SP. HubKribSP is the hub or KRIB SP the IdP sent
+	// the login to - it is only reused for requests sent by the same SP.
+	hubSSOEntry struct {
+		IdP, HubKribSP                                      string
+		Saved                                               int64
+		AuthnInstant, SessionNotOnOrAfter                   string
+		AuthnContextClassRef                                string
+		AuthenticatingAuthorities                           []string
+		NameID, NameIDFormat, SPNameQualifier, SessionIndex string
+		Attributes                                          []hubSSOAttribute
+	}
+
+	hubSSOAttribute struct {
+		Name, NameFormat string
+		Values           []string
+	}
+)
+
+const (
+	hubSSOCookieName = "HUBSSO"
+	// hubSSOMaxIdPs - the oldest logins are dropped when there are more
+	hubSSOMaxIdPs = 4
+
+	samlSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+)
+
+var (
+	hubSSONow = time.Now
+
+	hubSSODecisions = newCounterVec("wayf_hub_sso_total", "Hub SSO session decisions - reused or why the IdP was asked", "result")
+)
+
+// saveHubSSO saves the IdP's login in response to hubKribSP in the hub SSO session - if Conf.HubSSOTTL is set.
+// Only call it when the response has passed the same checks as a response that is sent on to the SP.
+func saveHubSSO(w http.ResponseWriter, r *http.Request, response *goxml.Xp, hubKribSP string) {
+	if stateFor(r).config.HubSSOTTL <= 0 || response.Query1(nil, "samlp:Status/samlp:StatusCode/@Value") != samlSuccess {
+		return
+	}
+	assertions := response.Query(nil, "saml:Assertion")
+	if len(assertions) == 0 {
+		return
+	}
+	assertion := assertions[0]
+	e := hubSSOEntry{
+		IdP:                       response.Query1(assertion, "saml:Issuer"),
+		HubKribSP:                 hubKribSP,
+		Saved:                     hubSSONow().Unix(),
+		AuthnInstant:              response.Query1(assertion, "saml:AuthnStatement/@AuthnInstant"),
+		SessionNotOnOrAfter:       response.Query1(assertion, "saml:AuthnStatement/@SessionNotOnOrAfter"),
+		AuthnContextClassRef:      response.Query1(assertion, "saml:AuthnStatement/saml:AuthnContext/saml:AuthnContextClassRef"),
+		AuthenticatingAuthorities: response.QueryMulti(assertion, "saml:AuthnStatement/saml:AuthnContext/saml:AuthenticatingAuthority"),
+		NameID:                    response.Query1(assertion, "saml:Subject/saml:NameID"),
+		NameIDFormat:              response.Query1(assertion, "saml:Subject/saml:NameID/@Format"),
+		SPNameQualifier:           response.Query1(assertion, "saml:Subject/saml:NameID/@SPNameQualifier"),
+		SessionIndex:              response.Query1(assertion, "saml:AuthnStatement/@SessionIndex"),
+	}
+	for _, attr := range response.Query(assertion, "saml:AttributeStatement/saml:Attribute") {
+		e.Attributes = append(e.Attributes, hubSSOAttribute{Name: response.Query1(attr, "@Name"), NameFormat: response.Query1(attr, "@NameFormat"), Values: response.QueryMulti(attr, "saml:AttributeValue")})
+	}
+
+	logins := loadHubSSO(w, r)
+	logins[hubSSOKey(e.IdP, e.HubKribSP)] = e
+	if len(logins) > hubSSOMaxIdPs {
+		keys := []string{}
+		for key := range logins {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return logins[keys[i]].Saved > logins[keys[j]].Saved })
+		for _, key := range keys[hubSSOMaxIdPs:] {
+			delete(logins, key)
+		}
+	}
+	if err := storeHubSSO(w, r, logins); err != nil {
+		logger.event(r, "hubsso", map[string]string{"error": err.Error()})
+	}
+}
+
+// hubSSOLogin answers request from the hub SSO session if it has a reusable login from realIDPMd - ok is false if the IdP must be asked.
+// The response goes through the same attribute handling as a response from the IdP.
+func hubSSOLogin(w http.ResponseWriter, r *http.Request, request, spMd, hubKribSPMd, realIDPMd *goxml.Xp, virtualIDPID, relayState string, spIndex, hubBirkIndex, hubKribSPIndex uint8) (ok bool, err error) {
+	if stateFor(r).config.HubSSOTTL <= 0 {
+		return
+	}
+	e, result := reusableHubSSO(w, r, request, spMd, realIDPMd.Query1(nil, "@entityID"), hubKribSPMd.Query1(nil, "@entityID"))
+	hubSSODecisions.inc(result)
+	if result != "reused" {
+		return
+	}
+	_, sRequest, err := gosaml.NewAuthnRequest(request, hubKribSPMd, realIDPMd, virtualIDPID, nil, "", false, spIndex, hubBirkIndex)
+	if err != nil {
+		return
+	}
+	spMd, hubBirkIDPMd, virtualIDPMd, spRequest, err := requestFromSamlRequest(r, sRequest, deploymentFor(r).intExtSP)
+	if err != nil {
+		return
+	}
+	logger.event(r, "hubsso", map[string]string{"idp": e.IdP, "authninstant": e.AuthnInstant})
+	return true, sendResponseToSP(w, r, e.response(spRequest), realIDPMd, hubKribSPMd, spMd, hubBirkIDPMd, virtualIDPMd, spRequest, sRequest, relayState, hubKribSPIndex, nil)
+}
+
+// reusableHubSSO returns the login from idp to hubKribSP if it can be used for request - result is reused or the reason it can not.
+// ForceAuthn requests always go to the IdP. IsPassive requests are answered from a usable login as the user does not have to do
+// anything - without one the IdP is asked, passively.
+func reusableHubSSO(w http.ResponseWriter, r *http.Request, request, spMd *goxml.Xp, idp, hubKribSP string) (e hubSSOEntry, result string) {
+	switch {
+	case request.QueryXMLBool(nil, "@ForceAuthn"):
+		return e, "forceauthn"
+	case spMd.QueryXMLBool(nil, xprefix+"noHubSSO"):
+		return e, "optout"
+	}
+	e, ok := loadHubSSO(w, r)[hubSSOKey(idp, hubKribSP)]
+	if !ok {
+		return e, "miss"
+	}
+	now := hubSSONow()
+	authnInstant, err := time.Parse(gosaml.XsDateTime, e.AuthnInstant)
+	if err != nil || now.Sub(authnInstant) >= stateFor(r).config.HubSSOTTL {
+		return e, "expired"
+	}
+	if notOnOrAfter, err := time.Parse(gosaml.XsDateTime, e.SessionNotOnOrAfter); err == nil && !now.Before(notOnOrAfter) {
+		return e, "expired"
+	}
+	if !authnContextSatisfied(request, e.AuthnContextClassRef) {
+		return e, "authncontext"
+	}
+	return e, "reused"
+}
+
+// hubSSOKey is the key for the login from idp to hubKribSP in the hub SSO session
+func hubSSOKey(idp, hubKribSP string) string {
+	return idp + " " + hubKribSP
+}
+
+// authnContextSatisfied checks classRef against the RequestedAuthnContext of request.
+// Only exact comparison is supported - minimum, better and maximum needs an ordering of the classes that we do not have.
+func authnContextSatisfied(request *goxml.Xp, classRef string) bool {
+	refs := request.QueryMulti(nil, "samlp:RequestedAuthnContext/saml:AuthnContextClassRef")
+	if len(refs) == 0 {
+		return true
+	}
+	if comparison := request.Query1(nil, "samlp:RequestedAuthnContext/@Comparison"); comparison != "" && comparison != "exact" {
+		return false
+	}
+	for _, ref := range refs {
+		if ref == classRef {
+			return true
+		}
+	}
+	return false
+}
+
+// response makes a Response from the IdP to request with the saved login
+func (e hubSSOEntry) response(request *goxml.Xp) (response *goxml.Xp) {
+	issueInstant, msgID, assertionID, _, _ := gosaml.IDAndTiming()
+	response = goxml.NewXpFromString("")
+	response.QueryDashP(nil, "/samlp:Response/@ID", msgID, nil)
+	response.QueryDashP(nil, "./@Version", "2.0", nil)
+	response.QueryDashP(nil, "./@IssueInstant", issueInstant, nil)
+	response.QueryDashP(nil, "./@InResponseTo", request.Query1(nil, "@ID"), nil)
+	response.QueryDashP(nil, "./saml:Issuer", e.IdP, nil)
+	response.QueryDashP(nil, "./samlp:Status/samlp:StatusCode/@Value", samlSuccess, nil)
+
+	response.QueryDashP(nil, "./saml:Assertion/@ID", assertionID, nil)
+	assertion := response.Query(nil, "saml:Assertion")[0]
+	response.QueryDashP(assertion, "@Version", "2.0", nil)
+	response.QueryDashP(assertion, "@IssueInstant", issueInstant, nil)
+	response.QueryDashP(assertion, "saml:Issuer", e.IdP, nil)
+	response.QueryDashP(assertion, "saml:Subject/saml:NameID", e.NameID, nil)
+	nameID := response.Query(assertion, "saml:Subject/saml:NameID")[0]
+	for attr, value := range map[string]string{"@Format": e.NameIDFormat, "@SPNameQualifier": e.SPNameQualifier} {
+		if value != "" {
+			response.QueryDashP(nameID, attr, value, nil)
+		}
+	}
+
+	response.QueryDashP(assertion, "saml:AuthnStatement/@AuthnInstant", e.AuthnInstant, nil)
+	authnStatement := response.Query(assertion, "saml:AuthnStatement")[0]
+	for attr, value := range map[string]string{"@SessionIndex": e.SessionIndex, "@SessionNotOnOrAfter": e.SessionNotOnOrAfter} {
+		if value != "" {
+			response.QueryDashP(authnStatement, attr, value, nil)
+		}
+	}
+	response.QueryDashP(authnStatement, "saml:AuthnContext/saml:AuthnContextClassRef", e.AuthnContextClassRef, nil)
+	for _, aa := range e.AuthenticatingAuthorities {
+		response.QueryDashP(authnStatement, "saml:AuthnContext/saml:AuthenticatingAuthority[0]", aa, nil)
+	}
+
+	for i, attr := range e.Attributes {
+		response.QueryDashP(assertion, fmt.Sprintf("saml:AttributeStatement/saml:Attribute[%d]/@Name", i+1), attr.Name, nil)
+		attribute := response.Query(assertion, fmt.Sprintf("saml:AttributeStatement/saml:Attribute[%d]", i+1))[0]
+		if attr.NameFormat != "" {
+			response.QueryDashP(attribute, "@NameFormat", attr.NameFormat, nil)
+		}
+		for j, value := range attr.Values {
+			response.QueryDashP(attribute, fmt.Sprintf("saml:AttributeValue[%d]", j+1), value, nil)
+		}
+	}
+	return
+}
+
+// clearHubSSO ends the hub SSO session - called when a logout starts
+func clearHubSSO(w http.ResponseWriter, r *http.Request) {
+	if stateFor(r).config.HubSSOTTL > 0 {
+		session.Del(w, r, hubSSOCookieName)
+	}
+}
+
+// loadHubSSO returns the saved logins by hubSSOKey - a session that can not be read is an empty one
+func loadHubSSO(w http.ResponseWriter, r *http.Request) (logins map[string]hubSSOEntry) {
+	logins = map[string]hubSSOEntry{}
+	sealed, err := session.Get(w, r, hubSSOCookieName)
+	if err != nil || len(sealed) == 0 {
+		return
+	}
+	compressed, err := openHubSSO(stateFor(r).sloInfoCookie, sealed)
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return
+	}
+	json.Unmarshal(data, &logins)
+	return
+}
+
+func storeHubSSO(w http.ResponseWriter, r *http.Request, logins map[string]hubSSOEntry) error {
+	data, err := json.Marshal(logins)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write(data)
+	fw.Close()
+	sealed, err := sealHubSSO(stateFor(r).sloInfoCookie, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return session.Set(w, r, hubSSOCookieName, sealed)
+}
+
+// sealHubSSO encrypts data with a key derived from the newest key in ring - the sloinfo cookie keys, the cookies are only signed.
+// The id of the key is prepended so older keys can still open it.
+func sealHubSSO(ring *cookieKeyRing, data []byte) ([]byte, error) {
+	id, hm := ring.newest()
+	aead, err := hubSSOAEAD(hm.Key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append([]byte{byte(len(id))}, id...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, data, []byte(hubSSOCookieName)), nil
+}
+
+func openHubSSO(ring *cookieKeyRing, sealed []byte) ([]byte, error) {
+	if len(sealed) == 0 || len(sealed) < 1+int(sealed[0]) {
+		return nil, errors.New("hubsso: too short")
+	}
+	hm, ok := ring.keys[string(sealed[1:1+int(sealed[0])])]
+	if !ok {
+		return nil, errors.New("hubsso: unknown key")
+	}
+	aead, err := hubSSOAEAD(hm.Key)
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[1+int(sealed[0]):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("hubsso: too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(hubSSOCookieName))
+}
+
+func hubSSOAEAD(key []byte) (cipher.AEAD, error) {
+	k := sha256.Sum256(append([]byte("hubsso:"), key...))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -1,29 +1,28 @@
 package wayfhybrid
 
 import (
+	"context"
 	"crypto"
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
-	"reflect"
+	"os/signal"
 	"regexp"
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	toml "github.com/pelletier/go-toml"
 	"github.com/wayf-dk/godiscoveryservice"
 	"github.com/wayf-dk/goeleven/src/goeleven"
 	"github.com/wayf-dk/gosaml"
@@ -68,6 +67,22 @@ type (
 		HubEntityID                                                                              string
 		EptidSalt                                                                                string
 		SecureCookieHashKey                                                                      string
+		AdminToken                                                                               string
+		ShutdownDelay, ShutdownGracePeriod                                                       time.Duration
+		ReadTimeout, ReadHeaderTimeout, WriteTimeout, IdleTimeout                                time.Duration
+		TLSMinVersion                                                                            string
+		TLSCurves, TLSCipherSuites                                                               []string
+		AdminIntf, AdminClientCA                                                                 string
+		CookieKeys                                                                               []struct{ ID, Key string }
+		TrustedProxies                                                                           []string
+		RateLimits                                                                               map[string]rateLimitConf
+		RateLimitAllowlist                                                                       []string // networks and SP entityIDs - an SP is only exempt from the per SP limit, its users are still limited per client IP
+		SecurityHeaders                                                                          map[string]string
+		CORSOrigins                                                                              []string
+		SessionStore, SessionDB                                                                  string
+		ReplayCache, ReplayCacheDB                                                               string
+		SLOFallback                                                                              string
+		HubSSOTTL                                                                                time.Duration
 		Intf, SsoService, HTTPSKey, HTTPSCert, Acs, Vvpmss                                       string
 		Birk, Krib, Dsbackend, Dstiming, Public, Discopublicpath, Discometadata, Discospmetadata string
 		TestSP, TestSPAcs, TestSPSlo, TestSP2, TestSP2Acs, TestSP2Slo, MDQ                       string
@@ -76,8 +91,15 @@ type (
 		Oauth                                                                                    string
 		ElementsToSign                                                                           []string
 		NotFoundRoutes                                                                           []string
-		Hub, Internal, ExternalIDP, ExternalSP                                                   struct{ Path, Table string }
+		Hub, Internal, ExternalIDP, ExternalSP                                                   mdConf
+		Hosts                                                                                    map[string]hostConf
 		MetadataFeeds                                                                            []struct{ Path, URL string }
+		MetadataRefresh                                                                          time.Duration
+		MetadataRefreshIntervals                                                                 map[string]time.Duration
+		MetadataGenerations                                                                      int
+		MetadataMaxSize                                                                          int64
+		MetadataMaxEntityDrop                                                                    int
+		MetadataSigningKey, MetadataManifestURL                                                  string
 		GoEleven                                                                                 goElevenConfig
 	}
 
@@ -99,7 +121,7 @@ type (
 		ForceConfirmation  bool
 		ConsentAsAService  string
 	}
-	// HybridSession - for session handling - pt. only cookies
+	// HybridSession - for session handling - the values are kept in cookies or server side - see Conf.SessionStore
 	HybridSession interface {
 		Set(http.ResponseWriter, *http.Request, string, []byte) error
 		Get(http.ResponseWriter, *http.Request, string) ([]byte, error)
@@ -111,12 +133,12 @@ type (
 		Hub, Internal, ExternalIDP, ExternalSP *lmdq.MDQ
 	}
 
+	// wayfHybridSession keeps each session value in it's own signed and encrypted cookie
 	wayfHybridSession struct{}
 
 	// https://stackoverflow.com/questions/47475802/golang-301-moved-permanently-if-request-path-contains-additional-slash
-	slashFix struct {
-		mux http.Handler
-	}
+	// the mux is the hybridMux of the running state when the request arrives - it is replaced when the config is reloaded
+	slashFix struct{}
 
 	attrValue struct {
 		Name, FriendlyName string
@@ -127,6 +149,29 @@ type (
 	webMd struct {
 		md, revmd *lmdq.MDQ
 	}
+
+	mdRefreshReport struct {
+		Status string       `json:"status"`
+		Feeds  []feedReport `json:"feeds,omitempty"`
+	}
+
+	feedReport struct {
+		Path        string  `json:"path"`
+		URL         string  `json:"url"`
+		Size        int64   `json:"size"`
+		SHA256      string  `json:"sha256"`
+		Entities    int     `json:"entities"`
+		NotModified bool    `json:"not_modified,omitempty"`
+		Pinned      string  `json:"pinned,omitempty"`
+		Seconds     float64 `json:"seconds"`
+
+		temp, etag, lastModified string // the downloaded mddb until it is installed and its validators
+	}
+
+	route struct {
+		name, pattern string
+		handler       http.Handler
+	}
 )
 
 var (
@@ -144,17 +189,20 @@ var (
 
 	metadataUpdateGuard chan int
 
-	session = wayfHybridSession{}
+	session HybridSession = wayfHybridSession{}
 
-	sloInfoCookie, authnRequestCookie *gosaml.Hm
-	tmpl                              *template.Template
+	sloInfoCookie, authnRequestCookie *cookieKeyRing
 	hostName                          string
+	configPath                        string
 
-	md mdSets
-
-	intExtSP, intExtIDP, hubExtIDP, hubExtSP gosaml.MdSets
+	// deployments - the per host deployments from Conf.Hosts - defaultDeployment is used for all other hosts
+	deployments       map[string]*deployment
+	defaultDeployment *deployment
 
-	webMdMap map[string]webMd
+	hybridMux    http.Handler
+	rateLimiters map[string]*routeLimiter
+	// stateLock protects everything a reload replaces - config, cookies, deployments, hybridMux and rateLimiters
+	stateLock sync.RWMutex
 )
 
 // Main - start the hybrid
@@ -164,21 +212,18 @@ func Main() {
 	hostName, _ = os.Hostname()
 
 	bypassMdUpdate := flag.Bool("nomd", false, "bypass MD update at start")
+	checkOnly := flag.Bool("checkconfig", false, "check the config and exit - non-zero exit status if any problems are found")
 	flag.Parse()
-	path := Env("WAYF_PATH", "/opt/wayf/")
+	configPath = Env("WAYF_PATH", "/opt/wayf/")
 
-	tomlConfig, err := toml.LoadFile(path + "hybrid-config/hybrid-config.toml")
-
-	if err != nil { // Handle errors reading the config file
-		panic(fmt.Errorf("fatal error config file: %s", err))
+	conf, err := loadConfig(configPath + "hybrid-config/hybrid-config.toml")
+	if *checkOnly {
+		os.Exit(checkConfigCmd(conf, err))
 	}
-	err = tomlConfig.Unmarshal(&config)
-	if err != nil {
+	if err != nil { // Handle errors reading the config file
 		panic(fmt.Errorf("fatal error %s", err))
 	}
-
-	overrideConfig(&config, []string{"EptidSalt"})
-	overrideConfig(&config.GoEleven, []string{"SlotPassword"})
+	config = conf
 
 	if config.GoEleven.SlotPassword != "" {
 		c := config.GoEleven
@@ -193,125 +238,180 @@ func Main() {
 		})
 	}
 
-	tmpl = template.Must(template.ParseFiles(path + "hybrid-config/templates/hybrid.tmpl"))
-	gosaml.PostForm = tmpl
+	if session, err = newSession(config); err != nil {
+		panic(err)
+	}
+	if replays, err = newReplayCache(config); err != nil {
+		panic(err)
+	}
+	if sloFallback, err = newSLOFallback(config); err != nil {
+		panic(err)
+	}
 
 	metadataUpdateGuard = make(chan int, 1)
 
 	goxml.Algos[""] = goxml.Algos[defaultDigestAndSignatureAlgorithm]
 
-	md.Hub = &lmdq.MDQ{Path: config.Hub.Path, Table: config.Hub.Table, Rev: config.Hub.Table, Short: "hub"}
-	md.Internal = &lmdq.MDQ{Path: config.Internal.Path, Table: config.Internal.Table, Rev: config.Internal.Table, Short: "int"}
-	md.ExternalIDP = &lmdq.MDQ{Path: config.ExternalIDP.Path, Table: config.ExternalIDP.Table, Rev: config.ExternalSP.Table, Short: "idp"}
-	md.ExternalSP = &lmdq.MDQ{Path: config.ExternalSP.Path, Table: config.ExternalSP.Table, Rev: config.ExternalIDP.Table, Short: "sp"}
+	report, err := refreshAllMetadataFeeds(!*bypassMdUpdate)
+	log.Printf("refreshAllMetadataFeeds: %s %v\n", report.Status, err)
+	addLiveGenerations(config)
+	go metadataScheduler()
 
-	intExtSP = gosaml.MdSets{md.Internal, md.ExternalSP}
-	intExtIDP = gosaml.MdSets{md.Internal, md.ExternalIDP}
-	hubExtIDP = gosaml.MdSets{md.Hub, md.ExternalIDP}
-	hubExtSP = gosaml.MdSets{md.Hub, md.ExternalSP}
+	st, err := newHybridState(config, nil)
+	if err != nil {
+		panic(err)
+	}
+	st.install()
 
-	str, err := refreshAllMetadataFeeds(!*bypassMdUpdate)
-	log.Printf("refreshAllMetadataFeeds: %s %v\n", str, err)
+	listenerErrors := make(chan error, 2)
 
-	webMdMap = make(map[string]webMd)
-	for _, md := range []*lmdq.MDQ{md.Hub, md.Internal, md.ExternalIDP, md.ExternalSP} {
-		err := md.Open()
-		if err != nil {
-			panic(err)
-		}
-		webMdMap[md.Table] = webMd{md: md}
-		webMdMap[md.Short] = webMd{md: md}
+	front, err := newFrontServer(config, &slashFix{})
+	if err != nil {
+		panic(err)
 	}
+	log.Println("listening on ", config.Intf)
+	go serve(front, listenerErrors, func() error { return front.ListenAndServeTLS("", "") }) // the certificate comes from TLSConfig.GetCertificate
 
-	for _, md := range []*lmdq.MDQ{md.Hub, md.Internal, md.ExternalIDP, md.ExternalSP} {
-		m := webMdMap[md.Table]
-		m.revmd = webMdMap[md.Rev].md
+	internal, err := newAdminServer(config, newAdminMux())
+	if err != nil {
+		panic(err)
 	}
+	log.Println("listening on ", internal.Addr)
+	go serve(internal, listenerErrors, func() error {
+		if internal.TLSConfig != nil {
+			return internal.ListenAndServeTLS("", "")
+		}
+		return internal.ListenAndServe()
+	})
 
-	godiscoveryservice.Config = godiscoveryservice.Conf{
-		DiscoMetaData: config.Discometadata,
-		SpMetaData:    config.Discospmetadata,
-	}
+	setReady(true)
 
-	gosaml.Config = gosaml.Conf{
-		SamlSchema: config.SamlSchema,
-		CertPath:   config.CertPath,
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	if err := waitForSignals(signals, listenerErrors, front, internal); err != nil {
+		log.Printf("main(): %s\n", err)
+		os.Exit(1)
 	}
+}
 
-	hashKey, _ := hex.DecodeString(config.SecureCookieHashKey)
-	authnRequestCookie = &gosaml.Hm{authnRequestTTL, sha256.New, hashKey}
-	gosaml.AuthnRequestCookie = authnRequestCookie
-	sloInfoCookie = &gosaml.Hm{sloInfoTTL, sha256.New, hashKey}
-
-	httpMux := http.NewServeMux()
+// newAdminMux makes the routes for the admin listener - all need the admin credentials. /metrics and /health/ready only report and take GET,
+// the others change state and take POST.
+func newAdminMux() *http.ServeMux {
+	mdUpdateMux := http.NewServeMux()
+	mdUpdateMux.Handle("/reload", adminHandler(reloadService))
+	mdUpdateMux.Handle("/metrics", adminReadHandler(metricsService))
+	mdUpdateMux.Handle("/health/ready", adminReadHandler(readyDetailsService))
+	mdUpdateMux.Handle("/generations", adminHandler(generationsService))
+	mdUpdateMux.Handle("/pin", adminHandler(pinService))
+	mdUpdateMux.Handle("/release", adminHandler(releaseService))
+	mdUpdateMux.Handle("/refresh", adminHandler(updateMetadataService))
+	mdUpdateMux.Handle("/", exactPath("/", adminHandler(updateMetadataService))) // the old refresh route - other paths are not found
+	return mdUpdateMux
+}
 
-	for _, pattern := range config.NotFoundRoutes {
-		httpMux.Handle(pattern, http.NotFoundHandler())
+// waitForSignals returns when a listener fails or when a TERM or INT has drained the servers.
+// A HUP reloads the config in the background so a TERM is never held up by a reload.
+func waitForSignals(signals <-chan os.Signal, listenerErrors <-chan error, servers ...*http.Server) error {
+	for {
+		select {
+		case err := <-listenerErrors:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				go func() {
+					if err := reloadConfig(); err != nil {
+						log.Printf("reload: %s - keeping current config\n", err)
+					}
+				}()
+				continue
+			}
+			log.Printf("main(): %s - draining\n", sig)
+			stateLock.RLock()
+			delay, gracePeriod := config.ShutdownDelay, config.ShutdownGracePeriod
+			stateLock.RUnlock()
+			return shutdown(delay, gracePeriod, servers...)
+		}
 	}
+}
 
-	httpMux.Handle("/production", appHandler(OkService))
-	//httpMux.Handle("/pprof", appHandler(PProf))
-	httpMux.Handle(config.Vvpmss, appHandler(VeryVeryPoorMansScopingService))
-	httpMux.Handle(config.SsoService, appHandler(SSOService))
-	httpMux.Handle(config.Oauth, appHandler(SSOService))
-	httpMux.Handle(config.Idpslo, appHandler(IDPSLOService))
-	httpMux.Handle(config.Birkslo, appHandler(BirkSLOService))
-	httpMux.Handle(config.Spslo, appHandler(SPSLOService))
-	httpMux.Handle(config.Kribslo, appHandler(KribSLOService))
-	httpMux.Handle(config.Nemloginslo, appHandler(SPSLOService))
-
-	httpMux.Handle(config.Acs, appHandler(ACSService))
-	httpMux.Handle(config.NemloginAcs, appHandler(ACSService))
-	httpMux.Handle(config.Birk, appHandler(SSOService))
-	httpMux.Handle(config.Krib, appHandler(ACSService))
-	httpMux.Handle(config.Dsbackend, appHandler(godiscoveryservice.DSBackend))
-	httpMux.Handle(config.Dstiming, appHandler(godiscoveryservice.DSTiming))
+// routes returns the routing for the front listener
+func routes(conf Conf) (rs []route) {
+	for _, pattern := range conf.NotFoundRoutes {
+		rs = append(rs, route{"NotFoundRoutes", pattern, http.NotFoundHandler()})
+	}
 
-	fs := http.FileServer(http.Dir(config.Discopublicpath))
+	fs := http.FileServer(http.Dir(conf.Discopublicpath))
 	f := func(w http.ResponseWriter, r *http.Request) (err error) {
 		fs.ServeHTTP(w, r)
 		return
 	}
 
-	httpMux.Handle(config.Public, appHandler(f))
-	httpMux.Handle(config.TestSP+"/ds/", appHandler(f))
-	httpMux.Handle(config.TestSP2+"/ds/", appHandler(f))
-
-	httpMux.Handle(config.Saml2jwt, appHandler(saml2jwt))
-	httpMux.Handle(config.Jwt2saml, appHandler(jwt2saml))
-	httpMux.Handle(config.MDQ, appHandler(MDQWeb))
-
-	httpMux.Handle(config.TestSPSlo, appHandler(testSPService))
-	httpMux.Handle(config.TestSPAcs, appHandler(testSPService))
-	httpMux.Handle(config.TestSP+"/", appHandler(testSPService)) // need a root "/" for routing
-
-	httpMux.Handle(config.TestSP2Slo, appHandler(testSPService))
-	httpMux.Handle(config.TestSP2Acs, appHandler(testSPService))
-	httpMux.Handle(config.TestSP2+"/", appHandler(testSPService)) // need a root "/" for routing
-
-	finish := make(chan bool)
-
-	go func() {
-		log.Println("listening on ", config.Intf)
-		err = http.ListenAndServeTLS(config.Intf, config.HTTPSCert, config.HTTPSKey, &slashFix{httpMux})
-		if err != nil {
-			log.Printf("main(): %s\n", err)
+	rs = append(rs, []route{
+		{"production", "/production", appHandler(OkService)},
+		{"live", "/health/live", appHandler(liveService)},
+		{"ready", "/health/ready", appHandler(readyService)},
+		//{"pprof", "/pprof", appHandler(PProf)},
+		{"Vvpmss", conf.Vvpmss, appHandler(VeryVeryPoorMansScopingService)},
+		{"SsoService", conf.SsoService, appHandler(SSOService)},
+		{"Oauth", conf.Oauth, appHandler(SSOService)},
+		{"Idpslo", conf.Idpslo, appHandler(IDPSLOService)},
+		{"Birkslo", conf.Birkslo, appHandler(BirkSLOService)},
+		{"Spslo", conf.Spslo, appHandler(SPSLOService)},
+		{"Kribslo", conf.Kribslo, appHandler(KribSLOService)},
+		{"Nemloginslo", conf.Nemloginslo, appHandler(SPSLOService)},
+
+		{"Acs", conf.Acs, appHandler(ACSService)},
+		{"NemloginAcs", conf.NemloginAcs, appHandler(ACSService)},
+		{"Birk", conf.Birk, appHandler(SSOService)},
+		{"Krib", conf.Krib, appHandler(ACSService)},
+		{"Dsbackend", conf.Dsbackend, appHandler(godiscoveryservice.DSBackend)},
+		{"Dstiming", conf.Dstiming, appHandler(godiscoveryservice.DSTiming)},
+
+		{"Public", conf.Public, appHandler(f)},
+		{"TestSP", conf.TestSP + "/ds/", appHandler(f)},
+		{"TestSP2", conf.TestSP2 + "/ds/", appHandler(f)},
+
+		{"Saml2jwt", conf.Saml2jwt, appHandler(saml2jwt)},
+		{"Jwt2saml", conf.Jwt2saml, appHandler(jwt2saml)},
+		{"MDQ", conf.MDQ, appHandler(MDQWeb)},
+
+		{"TestSPSlo", conf.TestSPSlo, appHandler(testSPService)},
+		{"TestSPAcs", conf.TestSPAcs, appHandler(testSPService)},
+		{"TestSP", conf.TestSP + "/", appHandler(testSPService)}, // need a root "/" for routing
+
+		{"TestSP2Slo", conf.TestSP2Slo, appHandler(testSPService)},
+		{"TestSP2Acs", conf.TestSP2Acs, appHandler(testSPService)},
+		{"TestSP2", conf.TestSP2 + "/", appHandler(testSPService)}, // need a root "/" for routing
+	}...)
+
+	names, hcs := hostConfs(conf)
+	for _, name := range names[1:] { // names[0] is the default
+		for _, testSP := range []struct{ name, host string }{{"TestSP", hcs[name].TestSP}, {"TestSP2", hcs[name].TestSP2}} {
+			if testSP.host != "" {
+				rs = append(rs, route{"Hosts." + name + "." + testSP.name, testSP.host + "/ds/", appHandler(f)})
+				rs = append(rs, route{"Hosts." + name + "." + testSP.name, testSP.host + "/", appHandler(testSPService)})
+			}
 		}
-	}()
-
-	mdUpdateMux := http.NewServeMux()
-	mdUpdateMux.Handle("/", appHandler(updateMetadataService)) // need a root "/" for routing
+	}
+	return
+}
 
-	go func() {
-		intf := regexp.MustCompile(`^(.*:).*$`).ReplaceAllString(config.Intf, "$1") + "9000"
-		log.Println("listening on ", intf)
-		err = http.ListenAndServe(intf, mdUpdateMux)
-		if err != nil {
-			log.Printf("main(): %s\n", err)
+// newMux sets up the routing for the front listener with the rate limits in limiters - http.ServeMux panics on empty and duplicate patterns, we return an error instead
+func newMux(conf Conf, limiters map[string]*routeLimiter) (mux *http.ServeMux, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("routing: %v", r)
 		}
 	}()
-
-	<-finish
+	mux = http.NewServeMux()
+	for _, rt := range routes(conf) {
+		h := rt.handler
+		if rl, ok := limiters[rt.name]; ok {
+			h = rl.wrap(h)
+		}
+		mux.Handle(rt.pattern, withRoute(rt.name, h))
+	}
+	return
 }
 
 func Env(name, defaultvalue string) string {
@@ -321,117 +421,141 @@ func Env(name, defaultvalue string) string {
 	return defaultvalue
 }
 
-func overrideConfig(config interface{}, envvars []string) {
-	for _, k := range envvars {
-		envvar := strings.ToUpper("WAYF_" + k)
-		log.Println(envvar)
-		if val, ok := os.LookupEnv(envvar); ok {
-			reflect.ValueOf(config).Elem().FieldByName(k).Set(reflect.ValueOf(val))
-		}
-	}
-}
-
 func (h *slashFix) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.URL.Path = strings.Replace(r.URL.Path, "//", "/", -1)
-	h.mux.ServeHTTP(w, r)
+	st := runningState() // a reload does not wait for the requests in flight - they finish with the state they started with
+	st.mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), stateKey{}, st)))
 }
 
-// Set responsible for setting a cookie values
-func (s wayfHybridSession) Set(w http.ResponseWriter, r *http.Request, id, domain string, data []byte, secCookie *gosaml.Hm, maxAge int) (err error) {
+// Set responsible for setting a cookie values - values too big for one cookie are split over at most maxCookieParts cookies
+func (s wayfHybridSession) Set(w http.ResponseWriter, r *http.Request, id string, data []byte) (err error) {
+	secCookie, maxAge := sessionParams(r, id)
 	cookie, err := secCookie.Encode(id, data)
-	// http.SetCookie(w, &http.Cookie{Name: id, Domain: domain, Value: cookie, Path: "/", Secure: true, HttpOnly: true, MaxAge: maxAge, SameSite: http.SameSiteNoneMode})
-	cc := http.Cookie{Name: id, Domain: domain, Value: cookie, Path: "/", Secure: true, HttpOnly: true, MaxAge: maxAge}
-	v := cc.String()
-	if !oldSafari.MatchString(r.Header.Get("User-Agent")) {
-		v = v + "; SameSite=None"
+	if err != nil {
+		return
 	}
-	w.Header().Add("Set-Cookie", v)
+	if id == sloCookieName || strings.HasPrefix(id, ssoCookieName) {
+		cookieSize.observe(float64(len(cookie)), cookieLabel(id))
+	}
+	parts := splitCookie(cookie)
+	if len(parts) > maxCookieParts {
+		return errCookieTooBig
+	}
+	for i, part := range parts {
+		setCookie(w, r, cookiePartName(id, i), part, maxAge)
+	}
+	s.delParts(w, r, id, len(parts))
 	return
 }
 
 // Get responsible for getting the cookie values
-func (s wayfHybridSession) Get(w http.ResponseWriter, r *http.Request, id string, secCookie *gosaml.Hm) (data []byte, err error) {
+func (s wayfHybridSession) Get(w http.ResponseWriter, r *http.Request, id string) (data []byte, err error) {
+	secCookie, _ := sessionParams(r, id)
 	cookie, err := r.Cookie(id)
 	if err == nil && cookie.Value != "" {
-		data, err = secCookie.Decode(id, cookie.Value)
-		if err != nil {
+		var value string
+		if value, err = joinCookie(r, id, cookie.Value); err != nil {
 			return
 		}
+		data, err = secCookie.Decode(id, value)
 	}
 	return
 }
 
 // Del responsible for deleting a cookie values
-func (s wayfHybridSession) Del(w http.ResponseWriter, r *http.Request, id, domain string, secCookie *gosaml.Hm) (err error) {
-	// http.SetCookie(w, &http.Cookie{Name: id, Domain: domain, Value: "", Path: "/", Secure: true, HttpOnly: true, Expires: time.Unix(0, 0),  SameSite: http.SameSiteNoneMode})
-	cc := http.Cookie{Name: id, Domain: domain, Value: "", Path: "/", Secure: true, HttpOnly: true, Expires: time.Unix(0, 0)}
-	v := cc.String()
-	if !oldSafari.MatchString(r.Header.Get("User-Agent")) {
-		v = v + "; SameSite=None"
-	}
-	w.Header().Add("Set-Cookie", v)
+func (s wayfHybridSession) Del(w http.ResponseWriter, r *http.Request, id string) (err error) {
+	setCookie(w, r, id, "", -1)
+	s.delParts(w, r, id, 1)
 	return
 }
 
 // GetDel responsible for getting and then deleting cookie values
-func (s wayfHybridSession) GetDel(w http.ResponseWriter, r *http.Request, id, domain string, secCookie *gosaml.Hm) (data []byte, err error) {
-	data, err = s.Get(w, r, id, secCookie)
-	s.Del(w, r, id, domain, secCookie)
+func (s wayfHybridSession) GetDel(w http.ResponseWriter, r *http.Request, id string) (data []byte, err error) {
+	data, err = s.Get(w, r, id)
+	s.Del(w, r, id)
 	return
 }
 
+// delParts deletes the parts of a split cookie from part from that the browser has sent
+func (s wayfHybridSession) delParts(w http.ResponseWriter, r *http.Request, id string, from int) {
+	for i := from; i < maxCookieParts; i++ {
+		if _, err := r.Cookie(cookiePartName(id, i)); err == nil {
+			setCookie(w, r, cookiePartName(id, i), "", -1)
+		}
+	}
+}
+
+// setCookie sets a cookie for the deployment's domain - a negative maxAge deletes it
+func setCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge int) {
+	// http.SetCookie(w, &http.Cookie{Name: id, Domain: domain, Value: cookie, Path: "/", Secure: true, HttpOnly: true, MaxAge: maxAge, SameSite: http.SameSiteNoneMode})
+	cc := http.Cookie{Name: name, Domain: deploymentFor(r).Domain, Value: value, Path: "/", Secure: true, HttpOnly: true, MaxAge: maxAge}
+	if maxAge < 0 {
+		cc.MaxAge, cc.Expires = 0, time.Unix(0, 0)
+	}
+	v := cc.String()
+	if !oldSafari.MatchString(r.Header.Get("User-Agent")) {
+		v = v + "; SameSite=None"
+	}
+	w.Header().Add("Set-Cookie", v)
+}
+
 // Write refers to writing log data
 func (writer logWriter) Write(bytes []byte) (int, error) {
 	return fmt.Fprint(os.Stderr, time.Now().UTC().Format("Jan _2 15:04:05 ")+string(bytes))
 }
 
-func legacyLog(stat, tag, idp, sp, hash string) {
+// legacyLog, legacyStatLog and legacyStatJSONLog are the adapter for the statistics consumers of the old line formats.
+// The lines are still written as before and are also logged as structured stat events.
+func legacyLog(r *http.Request, stat, tag, idp, sp, hash string) {
 	log.Printf("5 %s[%d] %s %s %s %s\n", stat, time.Now().UnixNano(), tag, idp, sp, hash)
+	logger.event(r, "stat", map[string]string{"stat": strings.TrimSpace(stat), "tag": tag, "idp": idp, "sp": sp, "hash": hash})
 }
 
-func legacyStatLog(tag, idp, sp, hash string) {
-	legacyLog("STAT ", tag, idp, sp, hash)
+func legacyStatLog(r *http.Request, tag, idp, sp, hash string) {
+	legacyLog(r, "STAT ", tag, idp, sp, hash)
 }
 
 // Mar 13 14:09:07 birk-03 birk[16805]: 5321bc0335b24 {} ...
-func legacyStatJSONLog(rec map[string]string) {
+func legacyStatJSONLog(r *http.Request, rec map[string]string) {
+	rec["request_id"] = requestID(r)
 	b, _ := json.Marshal(rec)
 	log.Printf("%d %s\n", time.Now().UnixNano(), b)
+	logger.event(r, "stat", rec)
 }
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	remoteAddr := r.RemoteAddr
-	if ra, ok := r.Header["X-Forwarded-For"]; ok {
-		remoteAddr = ra[0]
-	}
+	fn.serve(w, r, errorPage)
+}
 
-	//log.Printf("%s %s %s %+v", remoteAddr, r.Method, r.Host, r.URL)
+// serve runs fn and logs the request - an error is written to the client by writeError
+func (fn appHandler) serve(w http.ResponseWriter, r *http.Request, writeError func(http.ResponseWriter, *http.Request, error, *logRecord)) {
+	r, rec := withLogRecord(r)
+	w.Header().Set(requestIDHeader, rec.RequestID)
 	starttime := time.Now()
 	err := fn(w, r)
 
-	status := 200
+	rec.Status = http.StatusOK
+	rec.Latency = time.Since(starttime).Seconds()
 	if err != nil {
-		status = 500
-		if err.Error() == "401" {
-			status = 401
+		rec.Status = errorStatus(err)
+		rec.setError(err)
+		var x goxml.Werror
+		if errors.As(err, &x) && x.Xp != nil {
+			rec.Logtag = gosaml.DumpFile(r, x.Xp)
 		}
-		http.Error(w, err.Error(), status)
-	} else {
-		err = fmt.Errorf("OK")
+		writeError(w, r, err, rec)
 	}
+	logger.log(rec)
 
-	//log.Printf("%s: %s", err, r.Header.Get("User-Agent"))
-	log.Printf("%s %s %s %+v %1.3f %d %s", remoteAddr, r.Method, r.Host, r.URL, time.Since(starttime).Seconds(), status, err)
-
-	switch x := err.(type) {
-	case goxml.Werror:
-		if x.Xp != nil {
-			logtag := gosaml.DumpFile(r, x.Xp)
-			log.Print("logtag: " + logtag)
-		}
-		log.Print(x.FullError())
-		log.Print(x.Stack(5))
+	if rec.Route == "" { // not a front route
+		return
+	}
+	outcome := rec.ErrorClass
+	if outcome == "" {
+		outcome = "ok"
 	}
+	requestsTotal.inc(rec.Route, outcome)
+	requestDuration.observe(rec.Latency, rec.Route)
 }
 
 func PProf(w http.ResponseWriter, r *http.Request) (err error) {
@@ -440,71 +564,105 @@ func PProf(w http.ResponseWriter, r *http.Request) (err error) {
 	return
 }
 
-// updateMetadataService is service for updating metadata feed
+// updateMetadataService is service for updating metadata feed - returns a JSON report of the refreshed feeds
 func updateMetadataService(w http.ResponseWriter, r *http.Request) (err error) {
-	if str, err := refreshAllMetadataFeeds(true); err == nil {
-		io.WriteString(w, str)
+	report, err := refreshAllMetadataFeeds(true)
+	if err != nil {
+		return
 	}
-	return
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == "ignored" {
+		w.WriteHeader(http.StatusConflict)
+	}
+	return json.NewEncoder(w).Encode(report)
 }
 
 // refreshAllMetadataFeeds is responsible for referishing all metadata feed(internal, external)
-func refreshAllMetadataFeeds(refresh bool) (str string, err error) {
+func refreshAllMetadataFeeds(refresh bool) (report mdRefreshReport, err error) {
 	if !refresh {
-		return "bypassed", nil
+		return mdRefreshReport{Status: "bypassed"}, nil
 	}
+	return refreshFeeds()
+}
+
+// refreshFeeds refreshes the MetadataFeeds with paths - all of them if there are no paths - and switches to new metadata sets if any of them has changed.
+// Only one refresh runs at a time, the others are ignored. The config is taken when the refresh has the metadataUpdateGuard - a reload waits for
+// the guard, so the checks, the swap and the deployments are all done with the same config. Each feed is refreshed and swapped on its own - one
+// that fails is scheduled for a retry and the errors are returned together when the others are done.
+func refreshFeeds(paths ...string) (report mdRefreshReport, err error) {
 	select {
 	case metadataUpdateGuard <- 1:
 		{
-			for _, mdfeed := range config.MetadataFeeds {
-				if err = refreshMetadataFeed(mdfeed.Path, mdfeed.URL); err != nil {
-					<-metadataUpdateGuard
-					return "", err
+			defer func() { <-metadataUpdateGuard }()
+			conf := runningState().config
+			feeds := []struct{ Path, URL string }{}
+			for _, feed := range conf.MetadataFeeds {
+				if len(paths) == 0 || intersectionNotEmpty(paths, []string{feed.Path}) {
+					feeds = append(feeds, feed)
 				}
 			}
-			for _, md := range []gosaml.Md{md.Hub, md.Internal, md.ExternalIDP, md.ExternalSP} {
-				err := md.(*lmdq.MDQ).Open()
-				if err != nil {
-					panic(err)
+			report.Feeds = []feedReport{}
+			changed := []feedReport{}
+			defer func() {
+				for _, feed := range changed {
+					os.Remove(feed.temp) // gone if it was installed
+				}
+			}()
+			failed, errs := map[string]error{}, []error{}
+			for _, mdfeed := range feeds {
+				start := time.Now()
+				feed, err := refreshMetadataFeed(conf, mdfeed.Path, mdfeed.URL)
+				if err != nil { // the other feeds are still refreshed
+					feedDone(conf, mdfeed.Path, err)
+					errs = append(errs, fmt.Errorf("%s: %s", mdfeed.Path, err))
+					continue
+				}
+				if feed.Pinned == "" { // a pinned feed was left alone - there was no refresh to time
+					feed.Seconds = time.Since(start).Seconds()
+					feedRefreshDuration.set(feed.Seconds, feed.Path)
+				}
+				report.Feeds = append(report.Feeds, feed)
+				if !feed.NotModified {
+					changed = append(changed, feed)
 				}
 			}
-			godiscoveryservice.MetadataUpdated()
-			<-metadataUpdateGuard
-			return "Pong", nil
+			report.Status = "unchanged"
+			for _, feed := range changed { // one at a time - a feed that fails the checks does not keep the others out
+				if err := swapMetadata(conf, []feedReport{feed}); err != nil {
+					failed[feed.Path] = err
+					errs = append(errs, fmt.Errorf("%s: %s", feed.Path, err))
+					continue
+				}
+				report.Status = "refreshed"
+			}
+			for _, feed := range report.Feeds {
+				if feed.Pinned != "" {
+					feedPinned(conf, feed.Path)
+					continue
+				}
+				err := failed[feed.Path]
+				feedDone(conf, feed.Path, err)
+				if err == nil && !feed.NotModified {
+					setFeedValidators(feed.Path, feed.etag, feed.lastModified)
+					if err := addGeneration(conf, feed.Path, feed.SHA256, feedNow()); err != nil {
+						log.Printf("metadata generations: %s: %s\n", feed.Path, err)
+					}
+				}
+			}
+			if len(errs) > 0 {
+				return report, joinErrors(errs)
+			}
+			return report, nil
 		}
 	default:
 		{
-			return "Ignored", nil
+			return mdRefreshReport{Status: "ignored"}, nil
 		}
 	}
 }
 
-// refreshMetadataFeed is responsible for referishing a metadata feed
-func refreshMetadataFeed(mddbpath, url string) (err error) {
-	dir := path.Dir(mddbpath)
-	tempmddb, err := ioutil.TempFile(dir, "")
-	if err != nil {
-		return err
-	}
-	defer tempmddb.Close()
-	defer os.Remove(tempmddb.Name())
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	_, err = io.Copy(tempmddb, resp.Body)
-	if err != nil {
-		return err
-	}
-	if err = os.Rename(tempmddb.Name(), mddbpath); err != nil {
-		return err
-	}
-	return
-}
-
 func testSPService(w http.ResponseWriter, r *http.Request) (err error) {
+	d := deploymentFor(r)
 	defer r.Body.Close()
 	r.ParseForm()
 
@@ -514,7 +672,7 @@ func testSPService(w http.ResponseWriter, r *http.Request) (err error) {
 		AttrValues, DebugValues                                                    []attrValue
 	}
 
-	spMd, err := md.Internal.MDQ("https://" + r.Host)
+	spMd, err := d.mdq.Internal.MDQ("https://" + r.Host)
 	pk, _, _ := gosaml.GetPrivateKey(spMd, "md:SPSSODescriptor"+gosaml.EncryptionCertQuery)
 	idp := r.Form.Get("idpentityid") + r.Form.Get("entityID")
 	idpList := r.Form.Get("idplist")
@@ -522,7 +680,7 @@ func testSPService(w http.ResponseWriter, r *http.Request) (err error) {
 
 	if login || idp != "" || idpList != "" {
 
-		idpMd, err := md.Hub.MDQ(config.HubEntityID)
+		idpMd, err := d.mdq.Hub.MDQ(d.HubEntityID)
 		if err != nil {
 			return err
 		}
@@ -532,7 +690,7 @@ func testSPService(w http.ResponseWriter, r *http.Request) (err error) {
 			data.Set("return", "https://"+r.Host+r.RequestURI)
 			data.Set("returnIDParam", "idpentityid")
 			data.Set("entityID", "https://"+r.Host)
-			http.Redirect(w, r, config.DiscoveryService+data.Encode(), http.StatusFound)
+			http.Redirect(w, r, d.DiscoveryService+data.Encode(), http.StatusFound)
 			return err
 		}
 
@@ -545,7 +703,7 @@ func testSPService(w http.ResponseWriter, r *http.Request) (err error) {
 		}
 
 		if r.Form.Get("scoping") == "birk" {
-			idpMd, err = md.ExternalIDP.MDQ(scopedIDP)
+			idpMd, err = d.mdq.ExternalIDP.MDQ(scopedIDP)
 			if err != nil {
 				return err
 			}
@@ -590,11 +748,11 @@ func testSPService(w http.ResponseWriter, r *http.Request) (err error) {
 		http.Redirect(w, r, u.String(), http.StatusFound)
 		return nil
 	} else if r.Form.Get("logout") == "1" || r.Form.Get("logoutresponse") == "1" {
-		spMd, _, err := gosaml.FindInMetadataSets(gosaml.MdSets{md.Internal, md.ExternalSP}, r.Form.Get("destination"))
+		spMd, _, err := gosaml.FindInMetadataSets(gosaml.MdSets{d.mdq.Internal, d.mdq.ExternalSP}, r.Form.Get("destination"))
 		if err != nil {
 			return err
 		}
-		idpMd, _, err := gosaml.FindInMetadataSets(gosaml.MdSets{md.Hub, md.ExternalIDP}, r.Form.Get("issuer"))
+		idpMd, _, err := gosaml.FindInMetadataSets(gosaml.MdSets{d.mdq.Hub, d.mdq.ExternalIDP}, r.Form.Get("issuer"))
 		if err != nil {
 			return err
 		}
@@ -608,9 +766,9 @@ func testSPService(w http.ResponseWriter, r *http.Request) (err error) {
 		// don't do destination check - we accept and dumps anything ...
 		external := "0"
 		messages := "none"
-		response, issuerMd, destinationMd, relayState, _, _, err := gosaml.DecodeSAMLMsg(r, hubExtIDP, gosaml.MdSets{md.Internal}, gosaml.SPRole, []string{"Response", "LogoutRequest", "LogoutResponse"}, "https://"+r.Host+r.URL.Path, nil)
+		response, issuerMd, destinationMd, relayState, _, _, err := gosaml.DecodeSAMLMsg(r, d.hubExtIDP, gosaml.MdSets{d.mdq.Internal}, gosaml.SPRole, []string{"Response", "LogoutRequest", "LogoutResponse"}, "https://"+r.Host+r.URL.Path, nil)
 		if err != nil {
-			return err
+			return samlError(err)
 		}
 
 		var vals, debugVals []attrValue
@@ -618,9 +776,9 @@ func testSPService(w http.ResponseWriter, r *http.Request) (err error) {
 		protocol := response.QueryString(nil, "local-name(/*)")
 		if protocol == "Response" {
 			if err := gosaml.CheckDigestAndSignatureAlgorithms(response, allowedDigestAndSignatureAlgorithms, issuerMd.QueryMulti(nil, xprefix+"SigningMethod")); err != nil {
-				return err
+				return samlError(err)
 			}
-			hubMd, _ := md.Hub.MDQ(config.HubEntityID)
+			hubMd, _ := d.mdq.Hub.MDQ(d.HubEntityID)
 			vals = attributeValues(response, destinationMd, hubMd)
 			Attributesc14n(response, response, issuerMd, destinationMd)
 			err = wayfScopeCheck(response, issuerMd)
@@ -632,16 +790,16 @@ func testSPService(w http.ResponseWriter, r *http.Request) (err error) {
 
 		data := testSPFormData{RelayState: relayState, ResponsePP: incomingResponseXML, Destination: destinationMd.Query1(nil, "./@entityID"), Messages: messages,
 			Issuer: issuerMd.Query1(nil, "./@entityID"), External: external, Protocol: protocol, AttrValues: vals, DebugValues: debugVals, ScopedIDP: response.Query1(nil, "//saml:AuthenticatingAuthority")}
-		return tmpl.ExecuteTemplate(w, "testSPForm", data)
+		return d.tmpl.ExecuteTemplate(w, "testSPForm", data)
 	} else if r.Form.Get("ds") != "" {
 		data := url.Values{}
 		data.Set("return", "https://"+r.Host+r.RequestURI+"?previdplist="+r.Form.Get("scopedidp"))
 		data.Set("returnIDParam", "scopedidp")
 		data.Set("entityID", "https://"+r.Host)
-		http.Redirect(w, r, config.DiscoveryService+data.Encode(), http.StatusFound)
+		http.Redirect(w, r, d.DiscoveryService+data.Encode(), http.StatusFound)
 	} else {
 		data := testSPFormData{ScopedIDP: strings.Trim(r.Form.Get("scopedidp")+","+r.Form.Get("previdplist"), " ,")}
-		return tmpl.ExecuteTemplate(w, "testSPForm", data)
+		return d.tmpl.ExecuteTemplate(w, "testSPForm", data)
 	}
 	return
 }
@@ -687,7 +845,7 @@ func attributeValues(response, destinationMd, hubMd *goxml.Xp) (values []attrVal
 // checkForCommonFederations checks for common federation in sp and idp
 func checkForCommonFederations(response *goxml.Xp) (err error) {
 	if response.Query1(nil, "./saml:Assertion/saml:AttributeStatement/saml:Attribute[@Name='commonfederations']/saml:AttributeValue[1]") != "true" {
-		err = fmt.Errorf("no common federations")
+		err = newError(noCommonFederationsError, fmt.Errorf("no common federations"))
 	}
 	return
 }
@@ -695,19 +853,19 @@ func checkForCommonFederations(response *goxml.Xp) (err error) {
 func wayfScopeCheck(response, idpMd *goxml.Xp) (err error) {
 	as := response.Query(nil, "./saml:Assertion/saml:AttributeStatement")[0]
 	if response.QueryBool(as, "count(saml:Attribute[@Name='eduPersonPrincipalName']/saml:AttributeValue) != 1") {
-		err = fmt.Errorf("isRequired: eduPersonPrincipalName")
+		err = scopeErrorf("isRequired: eduPersonPrincipalName")
 		return
 	}
 
 	eppn := response.Query1(as, "saml:Attribute[@Name='eduPersonPrincipalName']/saml:AttributeValue")
 	securitydomain := response.Query1(as, "./saml:Attribute[@Name='securitydomain']/saml:AttributeValue")
 	if securitydomain == "" {
-		err = fmt.Errorf("not a scoped value: %s", eppn)
+		err = scopeErrorf("not a scoped value: %s", eppn)
 		return
 	}
 
 	if idpMd.QueryBool(nil, "count(//shibmd:Scope[.="+strconv.Quote(securitydomain)+"]) = 0") {
-		err = fmt.Errorf("security domain '%s' does not match any scopes", securitydomain)
+		err = scopeErrorf("security domain '%s' does not match any scopes", securitydomain)
 		return
 	}
 
@@ -715,19 +873,19 @@ func wayfScopeCheck(response, idpMd *goxml.Xp) (err error) {
 	for _, epsa := range response.QueryMulti(as, "./saml:Attribute[@Name='eduPersonScopedAffiliation']/saml:AttributeValue") {
 		epsaparts := scoped.FindStringSubmatch(epsa)
 		if len(epsaparts) != 3 {
-			err = fmt.Errorf("eduPersonScopedAffiliation: %s does not end with a domain", epsa)
+			err = scopeErrorf("eduPersonScopedAffiliation: %s does not end with a domain", epsa)
 			return
 		}
 		domain := epsaparts[2]
 		if domain != subsecuritydomain && !strings.HasSuffix(domain, "."+subsecuritydomain) {
-			err = fmt.Errorf("eduPersonScopedAffiliation: %s has not '%s' as security sub domain", epsa, subsecuritydomain)
+			err = scopeErrorf("eduPersonScopedAffiliation: %s has not '%s' as security sub domain", epsa, subsecuritydomain)
 			return
 		}
 	}
 	return
 }
 
-func wayfACSServiceHandler(idpMd, hubMd, spMd, request, response *goxml.Xp, birk bool) (ard AttributeReleaseData, err error) {
+func wayfACSServiceHandler(r *http.Request, idpMd, hubMd, spMd, request, response *goxml.Xp, birk bool) (ard AttributeReleaseData, err error) {
 	ard = AttributeReleaseData{IDPDisplayName: make(map[string]string), SPDisplayName: make(map[string]string), SPDescription: make(map[string]string)}
 	idp := idpMd.Query1(nil, "@entityID")
 
@@ -753,7 +911,8 @@ func wayfACSServiceHandler(idpMd, hubMd, spMd, request, response *goxml.Xp, birk
 	ard.SPEntityID = spMd.Query1(nil, "@entityID")
 	ard.BypassConfirmation = idpMd.QueryBool(nil, `count(`+xprefix+`consent.disable[.= `+strconv.Quote(ard.SPEntityID)+`]) > 0`)
 	ard.BypassConfirmation = ard.BypassConfirmation || spMd.QueryXMLBool(nil, xprefix+`consent.disable`)
-	ard.ConsentAsAService = config.ConsentAsAService
+	conf := stateFor(r).config
+	ard.ConsentAsAService = conf.ConsentAsAService
 
 	if birk {
 		//Jun 19 09:42:58 birk-06 birk[18847]: 1529401378 {"action":"send","type":"samlp:Response","us":"https:\/\/birk.wayf.dk\/birk.php\/nemlogin.wayf.dk","destination":"https:\/\/europe.wiseflow.net","ip":"109.105.112.132","ts":1529401378,"host":"birk-06","logtag":1529401378}
@@ -762,20 +921,20 @@ func wayfACSServiceHandler(idpMd, hubMd, spMd, request, response *goxml.Xp, birk
 			"type":        "samlp:Response",
 			"us":          ard.IDPEntityID,
 			"destination": ard.SPEntityID,
-			"ip":          "0.0.0.0",
+			"ip":          remoteIP(r),
 			"ts":          strconv.FormatInt(time.Now().Unix(), 10),
 			"host":        hostName,
 			"logtag":      strconv.FormatInt(time.Now().UnixNano(), 10),
 		}
-		legacyStatJSONLog(jsonlog)
+		legacyStatJSONLog(r, jsonlog)
 	}
 	eppn := response.Query1(nil, "./saml:Assertion/saml:AttributeStatement/saml:Attribute[@Name='eduPersonPrincipalName']/saml:AttributeValue")
-	hashedEppn := fmt.Sprintf("%x", goxml.Hash(crypto.SHA256, config.SaltForHashedEppn+eppn))
-	legacyStatLog("saml20-idp-SSO", ard.SPEntityID, idp, hashedEppn)
+	hashedEppn := fmt.Sprintf("%x", goxml.Hash(crypto.SHA256, conf.SaltForHashedEppn+eppn))
+	legacyStatLog(r, "saml20-idp-SSO", ard.SPEntityID, idp, hashedEppn)
 	return
 }
 
-func wayfKribHandler(idpMd, spMd, request, response *goxml.Xp) (ard AttributeReleaseData, err error) {
+func wayfKribHandler(r *http.Request, idpMd, spMd, request, response *goxml.Xp) (ard AttributeReleaseData, err error) {
 	// we ignore the qualifiers and use the idp and sp entityIDs
 	as := response.Query(nil, "./saml:Assertion/saml:AttributeStatement")[0]
 	securitydomain := response.Query1(as, "./saml:Attribute[@Name='securitydomain']/saml:AttributeValue")
@@ -801,29 +960,20 @@ func wayfKribHandler(idpMd, spMd, request, response *goxml.Xp) (ard AttributeRel
 	return
 }
 
-// OkService - exits with eror of HSM is unavailable
-func OkService(w http.ResponseWriter, r *http.Request) (err error) {
-	err = goeleven.HSMStatus()
-	if err != nil {
-		os.Exit(1)
-	}
-	return
-}
-
 // VeryVeryPoorMansScopingService handles poor man's scoping
 func VeryVeryPoorMansScopingService(w http.ResponseWriter, r *http.Request) (err error) {
 	cc := http.Cookie{Name: "vvpmss", Value: r.URL.Query().Get("idplist"), Path: "/", Secure: true, HttpOnly: true, MaxAge: 10}
 	v := cc.String() + "; SameSite=None"
 	w.Header().Add("Set-Cookie", v)
-	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	allowOrigin(w, r, nil)
 	w.Header().Set("Content-Type", "text/plain")
 	io.WriteString(w, hostName+"\n")
 	return
 }
 
 func wayf(w http.ResponseWriter, r *http.Request, request, spMd, idpMd *goxml.Xp) (idp string) {
-	if idp = idpMd.Query1(nil, "@entityID"); idp != config.HubEntityID { // no need for wayf if idp is birk entity - ie. not the hub
+	d := deploymentFor(r)
+	if idp = idpMd.Query1(nil, "@entityID"); idp != d.HubEntityID { // no need for wayf if idp is birk entity - ie. not the hub
 		return
 	}
 	sp := spMd.Query1(nil, "@entityID") // real entityID == KRIB entityID
@@ -865,15 +1015,21 @@ func wayf(w http.ResponseWriter, r *http.Request, request, spMd, idpMd *goxml.Xp
 	data.Set("return", "https://"+r.Host+r.RequestURI)
 	data.Set("returnIDParam", "idpentityid")
 	data.Set("entityID", sp)
-	http.Redirect(w, r, config.DiscoveryService+data.Encode(), http.StatusFound)
+	http.Redirect(w, r, d.DiscoveryService+data.Encode(), http.StatusFound)
 	return "" // needed to tell our caller to return for discovery ...
 }
 
 // SSOService handles single sign on requests
 func SSOService(w http.ResponseWriter, r *http.Request) (err error) {
+	d := deploymentFor(r)
 	defer r.Body.Close()
-	request, spMd, hubBirkMd, relayState, spIndex, hubBirkIndex, err := gosaml.ReceiveAuthnRequest(r, intExtSP, hubExtIDP, "https://"+r.Host+r.URL.Path)
+	request, spMd, hubBirkMd, relayState, spIndex, hubBirkIndex, err := gosaml.ReceiveAuthnRequest(r, d.intExtSP, d.hubExtIDP, "https://"+r.Host+r.URL.Path)
 	if err != nil {
+		return samlError(err)
+	}
+	rec := logRecordFor(r)
+	rec.SP = spMd.Query1(nil, "@entityID")
+	if err = limitSP(r, rec.SP); err != nil {
 		return
 	}
 
@@ -881,7 +1037,8 @@ func SSOService(w http.ResponseWriter, r *http.Request) (err error) {
 	if VirtualIDPID == "" {
 		return
 	}
-	virtualIDPMd, virtualIDPIndex, err := gosaml.FindInMetadataSets(intExtIDP, VirtualIDPID) // find in internal also if birk
+	rec.IdP = VirtualIDPID
+	virtualIDPMd, virtualIDPIndex, err := gosaml.FindInMetadataSets(d.intExtIDP, VirtualIDPID) // find in internal also if birk
 	if err != nil {
 		return
 	}
@@ -895,35 +1052,39 @@ func SSOService(w http.ResponseWriter, r *http.Request) (err error) {
 	realIDPMd := virtualIDPMd
 	var hubKribSPMd *goxml.Xp
 	if virtualIDPIndex == 0 { // to internal IDP - also via BIRK
-		hubKribSP := config.HubEntityID
+		hubKribSP := d.HubEntityID
 		if tmp := virtualIDPMd.Query1(nil, xprefix+"map2SP"); tmp != "" {
 			hubKribSP = tmp
 		}
 
-		if hubKribSPMd, err = md.Hub.MDQ(hubKribSP); err != nil {
+		if hubKribSPMd, err = d.mdq.Hub.MDQ(hubKribSP); err != nil {
 			return
 		}
 
 		realIDP := virtualIDPMd.Query1(nil, xprefix+"map2IdP")
 
 		if realIDP != "" {
-			realIDPMd, err = md.Internal.MDQ(realIDP)
+			realIDPMd, err = d.mdq.Internal.MDQ(realIDP)
 			if err != nil {
 				return
 			}
 		}
 	} else { // to external IDP - send as KRIB
-		hubKribSPMd, err = md.ExternalSP.MDQ(spMd.Query1(nil, "@entityID"))
+		hubKribSPMd, err = d.mdq.ExternalSP.MDQ(spMd.Query1(nil, "@entityID"))
 		if err != nil {
 			return
 		}
 	}
 
-	err = sendRequestToIDP(w, r, request, spMd, hubKribSPMd, realIDPMd, VirtualIDPID, relayState, ssoCookieName, "", config.Domain, spIndex, hubBirkIndex, nil)
+	if ok, err := hubSSOLogin(w, r, request, spMd, hubKribSPMd, realIDPMd, VirtualIDPID, relayState, spIndex, hubBirkIndex, virtualIDPIndex); ok || err != nil {
+		return err
+	}
+
+	err = sendRequestToIDP(w, r, request, spMd, hubKribSPMd, realIDPMd, VirtualIDPID, relayState, ssoCookieName, "", spIndex, hubBirkIndex, nil)
 	return
 }
 
-func sendRequestToIDP(w http.ResponseWriter, r *http.Request, request, spMd, hubKribSPMd, realIDPMd *goxml.Xp, virtualIDPID, relayState, prefix, altAcs, domain string, spIndex, hubBirkIndex uint8, idPList []string) (err error) {
+func sendRequestToIDP(w http.ResponseWriter, r *http.Request, request, spMd, hubKribSPMd, realIDPMd *goxml.Xp, virtualIDPID, relayState, prefix, altAcs string, spIndex, hubBirkIndex uint8, idPList []string) (err error) {
 	// why not use orig request?
 	wantRequesterID := realIDPMd.QueryXMLBool(nil, xprefix+`wantRequesterID`) || gosaml.DebugSetting(r, "wantRequesterID") != ""
 	newrequest, sRequest, err := gosaml.NewAuthnRequest(request, hubKribSPMd, realIDPMd, virtualIDPID, idPList, altAcs, wantRequesterID, spIndex, hubBirkIndex)
@@ -931,8 +1092,10 @@ func sendRequestToIDP(w http.ResponseWriter, r *http.Request, request, spMd, hub
 		return
 	}
 
-	buf := sRequest.Marshal()
-	session.Set(w, r, prefix+gosaml.IDHash(newrequest.Query1(nil, "./@ID")), domain, buf, authnRequestCookie, authnRequestTTL)
+	buf := marshalSamlRequest(sRequest, requestID(r))
+	if err = session.Set(w, r, prefix+gosaml.IDHash(newrequest.Query1(nil, "./@ID")), buf); err != nil {
+		return
+	}
 	var privatekey []byte
 	if realIDPMd.QueryXMLBool(nil, `./md:IDPSSODescriptor/@WantAuthnRequestsSigned`) || hubKribSPMd.QueryXMLBool(nil, `./md:SPSSODescriptor/@AuthnRequestsSigned`) || gosaml.DebugSetting(r, "idpSigAlg") != "" {
 		privatekey, _, err = gosaml.GetPrivateKey(hubKribSPMd, "md:SPSSODescriptor"+gosaml.EncryptionCertQuery)
@@ -943,25 +1106,33 @@ func sendRequestToIDP(w http.ResponseWriter, r *http.Request, request, spMd, hub
 
 	algo := gosaml.DebugSettingWithDefault(r, "idpSigAlg", realIDPMd.Query1(nil, xprefix+"SigningMethod"))
 
-	u, err := gosaml.SAMLRequest2URL(newrequest, relayState, string(privatekey), "-", algo)
+	var u *url.URL
+	if privatekey == nil { // not signed - nothing to time
+		u, err = gosaml.SAMLRequest2URL(newrequest, relayState, "", "-", algo)
+	} else {
+		err = timeSigning(privatekey, func() (err error) {
+			u, err = gosaml.SAMLRequest2URL(newrequest, relayState, string(privatekey), "-", algo)
+			return
+		})
+	}
 	if err != nil {
 		return
 	}
 
-	legacyLog("", "SAML2.0 - IDP.SSOService: Incomming Authentication request:", "'"+request.Query1(nil, "./saml:Issuer")+"'", "", "")
+	legacyLog(r, "", "SAML2.0 - IDP.SSOService: Incomming Authentication request:", "'"+request.Query1(nil, "./saml:Issuer")+"'", "", "")
 	if hubBirkIndex == 1 {
 		var jsonlog = map[string]string{
 			"action": "receive",
 			"type":   "samlp:AuthnRequest",
 			"src":    request.Query1(nil, "./saml:Issuer"),
 			"us":     virtualIDPID,
-			"ip":     r.RemoteAddr,
+			"ip":     remoteIP(r),
 			"ts":     strconv.FormatInt(time.Now().Unix(), 10),
 			"host":   hostName,
 			"logtag": strconv.FormatInt(time.Now().UnixNano(), 10),
 		}
 
-		legacyStatJSONLog(jsonlog)
+		legacyStatJSONLog(r, jsonlog)
 	}
 
 	http.Redirect(w, r, u.String(), http.StatusFound)
@@ -969,16 +1140,20 @@ func sendRequestToIDP(w http.ResponseWriter, r *http.Request, request, spMd, hub
 }
 
 func getOriginalRequest(w http.ResponseWriter, r *http.Request, response *goxml.Xp, issuerMdSets, destinationMdSets gosaml.MdSets, prefix string) (spMd, hubBirkIDPMd, virtualIDPMd, request *goxml.Xp, sRequest gosaml.SamlRequest, err error) {
-	gosaml.DumpFileIfTracing(r, response)
+	dumpFileIfTracing(r, response)
+	if err = checkReplay(r, response); err != nil {
+		return
+	}
 	inResponseTo := response.Query1(nil, "./@InResponseTo")
-	tmpID, err := session.GetDel(w, r, prefix+gosaml.IDHash(inResponseTo), config.Domain, authnRequestCookie)
+	tmpID, err := session.GetDel(w, r, prefix+gosaml.IDHash(inResponseTo))
 	//tmpID, err := authnRequestCookie.SpcDecode("id", inResponseTo[1:], gosaml.SRequestPrefixLength) // skip _
 	if err != nil {
 		return
 	}
-	sRequest.Unmarshal(tmpID)
+	id := unmarshalSamlRequest(&sRequest, tmpID)
+	adoptRequestID(w, r, id)
 
-	// we need to disable the replay attack mitigation based on the cookie - we are now fully dependent on the ttl on the data - pt. 3 mins
+	// the replay attack mitigation based on the cookie is replaced by checkReplay - a replayed response comes with the cookie
 	//	if inResponseTo != sRequest.Nonce {
 	//		err = fmt.Errorf("response.InResponseTo != request.ID")
 	//		return
@@ -987,18 +1162,24 @@ func getOriginalRequest(w http.ResponseWriter, r *http.Request, response *goxml.
 	if sRequest.RequestID == "" { // This is a non-hub request - no original actual original request - just checking if response/@InResponseTo == request/@ID
 		return nil, nil, nil, nil, sRequest, nil
 	}
+	spMd, hubBirkIDPMd, virtualIDPMd, request, err = requestFromSamlRequest(r, sRequest, issuerMdSets)
+	return
+}
 
+// requestFromSamlRequest recreates the SP's request and finds the metadata needed for the response from the saved sRequest
+func requestFromSamlRequest(r *http.Request, sRequest gosaml.SamlRequest, issuerMdSets gosaml.MdSets) (spMd, hubBirkIDPMd, virtualIDPMd, request *goxml.Xp, err error) {
+	d := deploymentFor(r)
 	if spMd, err = issuerMdSets[sRequest.SPIndex].MDQ(sRequest.SP); err != nil {
 		return
 	}
 
-	if virtualIDPMd, err = md.ExternalIDP.MDQ(sRequest.VirtualIDPID); err != nil {
+	if virtualIDPMd, err = d.mdq.ExternalIDP.MDQ(sRequest.VirtualIDPID); err != nil {
 		return
 	}
 
 	hubBirkIDPMd = virtualIDPMd     // who to send the response as - BIRK
 	if sRequest.HubBirkIndex == 0 { // or hub is request was to the hub
-		if hubBirkIDPMd, err = md.Hub.MDQ(config.HubEntityID); err != nil {
+		if hubBirkIDPMd, err = d.mdq.Hub.MDQ(d.HubEntityID); err != nil {
 			return
 		}
 	}
@@ -1014,48 +1195,90 @@ func getOriginalRequest(w http.ResponseWriter, r *http.Request, response *goxml.
 	return
 }
 
+// marshalSamlRequest marshals sRequest with the request id in front - r<len><id>
+// gosaml's own format starts with a 'b' so cookies without the id can still be read
+func marshalSamlRequest(sRequest gosaml.SamlRequest, id string) (msg []byte) {
+	if id != "" {
+		msg = append([]byte{'r', byte(len(id))}, id...)
+	}
+	return append(msg, sRequest.Marshal()...)
+}
+
+// unmarshalSamlRequest is the reverse of marshalSamlRequest - returns the request id
+func unmarshalSamlRequest(sRequest *gosaml.SamlRequest, msg []byte) (id string) {
+	if len(msg) > 2 && msg[0] == 'r' && len(msg) >= int(msg[1])+2 {
+		id, msg = string(msg[2:2+int(msg[1])]), msg[2+int(msg[1]):]
+	}
+	sRequest.Unmarshal(msg)
+	return
+}
+
 // ACSService handles all the stuff related to receiving response and attribute handling
 func ACSService(w http.ResponseWriter, r *http.Request) (err error) {
+	d := deploymentFor(r)
 	defer r.Body.Close()
-	hubMd, _ := md.Hub.MDQ(config.HubEntityID)
+	hubMd, _ := d.mdq.Hub.MDQ(d.HubEntityID)
 	hubIdpCerts := hubMd.QueryMulti(nil, "md:IDPSSODescriptor"+gosaml.SigningCertQuery)
-	response, idpMd, hubKribSpMd, relayState, _, hubKribSpIndex, err := gosaml.ReceiveSAMLResponse(r, intExtIDP, hubExtSP, "https://"+r.Host+r.URL.Path, hubIdpCerts)
+	response, idpMd, hubKribSpMd, relayState, _, hubKribSpIndex, err := gosaml.ReceiveSAMLResponse(r, d.intExtIDP, d.hubExtSP, "https://"+r.Host+r.URL.Path, hubIdpCerts)
 	if err != nil {
-		return
+		return samlError(err)
 	}
+	rec := logRecordFor(r)
+	rec.IdP = idpMd.Query1(nil, "@entityID")
 
 	iiXml := response.Query1(nil, "saml:Assertion/@IssueInstant")
 	aiXml := response.Query1(nil, "saml:Assertion/saml:AuthnStatement/@AuthnInstant")
 	ii, _ := time.Parse(gosaml.XsDateTime, iiXml)
 	ai, _ := time.Parse(gosaml.XsDateTime, aiXml)
-	log.Printf("AuthnInstant: %s %v \n", response.Query1(nil, "saml:Issuer"), ii.Sub(ai))
+	logger.event(r, "authninstant", map[string]string{"issuer": response.Query1(nil, "saml:Issuer"), "age": ii.Sub(ai).String()})
 
-	spMd, hubBirkIDPMd, virtualIDPMd, request, sRequest, err := getOriginalRequest(w, r, response, intExtSP, hubExtIDP, ssoCookieName)
+	spMd, hubBirkIDPMd, virtualIDPMd, request, sRequest, err := getOriginalRequest(w, r, response, d.intExtSP, d.hubExtIDP, ssoCookieName)
 	if err != nil {
 		return
 	}
+	rec.SP = spMd.Query1(nil, "@entityID")
 
 	if err = gosaml.CheckDigestAndSignatureAlgorithms(response, allowedDigestAndSignatureAlgorithms, virtualIDPMd.QueryMulti(nil, xprefix+"SigningMethod")); err != nil {
-		return
+		return samlError(err)
 	}
 
+	var checked func()
+	if stateFor(r).config.HubSSOTTL > 0 {
+		idpResponse, hubKribSP := response.CpXp(), hubKribSpMd.Query1(nil, "@entityID") // saved as the IdP sent it - sendResponseToSP changes response
+		checked = func() { saveHubSSO(w, r, idpResponse, hubKribSP) }
+	}
+	return sendResponseToSP(w, r, response, idpMd, hubKribSpMd, spMd, hubBirkIDPMd, virtualIDPMd, request, sRequest, relayState, hubKribSpIndex, checked)
+}
+
+// sendResponseToSP makes, signs and posts the response to the SP from the IdP's response - also used for logins from the hub SSO session.
+// checked - if not nil - is called when a successful response has passed the scope, federation and attribute checks.
+func sendResponseToSP(w http.ResponseWriter, r *http.Request, response, idpMd, hubKribSpMd, spMd, hubBirkIDPMd, virtualIDPMd, request *goxml.Xp, sRequest gosaml.SamlRequest, relayState string, hubKribSpIndex uint8, checked func()) (err error) {
+	d := deploymentFor(r)
+	rec := logRecordFor(r)
+	hubMd, _ := d.mdq.Hub.MDQ(d.HubEntityID)
 	signingMethod := gosaml.DebugSettingWithDefault(r, "spSigAlg", spMd.Query1(nil, xprefix+"SigningMethod"))
 
 	var newresponse *goxml.Xp
 	var ard AttributeReleaseData
 	if response.Query1(nil, `samlp:Status/samlp:StatusCode/@Value`) == "urn:oasis:names:tc:SAML:2.0:status:Success" {
 		Attributesc14n(request, response, virtualIDPMd, spMd)
-		if err = checkForCommonFederations(response); err != nil {
-			return
-		}
-		if hubKribSpIndex == 0 { // to the hub itself
-			ard, err = wayfACSServiceHandler(virtualIDPMd, hubMd, spMd, request, response, sRequest.HubBirkIndex == 1)
-		} else { // krib
-			ard, err = wayfKribHandler(virtualIDPMd, spMd, request, response)
+		if err = checkForCommonFederations(response); err == nil {
+			if hubKribSpIndex == 0 { // to the hub itself
+				ard, err = wayfACSServiceHandler(r, virtualIDPMd, hubMd, spMd, request, response, sRequest.HubBirkIndex == 1)
+			} else { // krib
+				ard, err = wayfKribHandler(r, virtualIDPMd, spMd, request, response)
+			}
 		}
 		if err != nil {
+			if spMd.QueryXMLBool(nil, xprefix+"errorResponse") && sRequest.Protocol == "" {
+				rec.setError(err)
+				return sendErrorResponse(w, r, err, hubBirkIDPMd, spMd, request, response, relayState, signingMethod)
+			}
 			return goxml.Wrap(err)
 		}
+		if checked != nil {
+			checked()
+		}
 
 		if gosaml.DebugSetting(r, "scopingError") != "" {
 			eppnPath := `./saml:Assertion/saml:AttributeStatement/saml:Attribute[@Name="eduPersonPrincipalName"]/saml:AttributeValue`
@@ -1155,7 +1378,7 @@ func ACSService(w http.ResponseWriter, r *http.Request) (err error) {
 			newresponse.QueryDashP(nil, "./saml:Assertion/saml:Conditions/@NotOnOrAfter", issueInstant.Add(ad).Format(gosaml.XsDateTime), nil)
 		}
 
-		elementsToSign := config.ElementsToSign
+		elementsToSign := stateFor(r).config.ElementsToSign
 		if spMd.QueryXMLBool(nil, xprefix+"saml20.sign.response") {
 			elementsToSign = []string{"/samlp:Response"}
 		}
@@ -1174,18 +1397,19 @@ func ACSService(w http.ResponseWriter, r *http.Request) (err error) {
 		}
 
 		for _, q := range elementsToSign {
-			err = gosaml.SignResponse(newresponse, q, hubBirkIDPMd, signingMethod, signingType)
+			err = signResponse(newresponse, q, hubBirkIDPMd, signingMethod, signingType)
 			if err != nil {
 				return err
 			}
 		}
+		loginsTotal.inc(rec.IdP, rec.SP)
 
 		if gosaml.DebugSetting(r, "signingError") == "1" {
 			newresponse.QueryDashP(nil, `./saml:Assertion/@ID`, newresponse.Query1(nil, `./saml:Assertion/@ID`)+"1", nil)
 		}
 
 		if spMd.QueryXMLBool(nil, xprefix+"assertion.encryption ") || gosaml.DebugSetting(r, "encryptAssertion") == "1" {
-			gosaml.DumpFileIfTracing(r, newresponse)
+			dumpFileIfTracing(r, newresponse)
 			cert := spMd.Query1(nil, "./md:SPSSODescriptor"+gosaml.EncryptionCertQuery) // actual encryption key is always first
 			_, publicKey, _ := gosaml.PublicKeyInfo(cert)
 			assertion := newresponse.Query(nil, "saml:Assertion[1]")[0]
@@ -1194,7 +1418,7 @@ func ACSService(w http.ResponseWriter, r *http.Request) (err error) {
 	} else {
 		newresponse = gosaml.NewErrorResponse(hubBirkIDPMd, spMd, request, response)
 
-		err = gosaml.SignResponse(newresponse, "/samlp:Response", hubBirkIDPMd, signingMethod, gosaml.SAMLSign)
+		err = signResponse(newresponse, "/samlp:Response", hubBirkIDPMd, signingMethod, gosaml.SAMLSign)
 		if err != nil {
 			return
 		}
@@ -1209,7 +1433,7 @@ func ACSService(w http.ResponseWriter, r *http.Request) (err error) {
 		return goxml.Wrap(err)
 	}
 
-	gosaml.DumpFileIfTracing(r, newresponse)
+	dumpFileIfTracing(r, newresponse)
 
 	var samlResponse string
 	if sRequest.Protocol == "wsfed" {
@@ -1218,45 +1442,97 @@ func ACSService(w http.ResponseWriter, r *http.Request) (err error) {
 		samlResponse = base64.StdEncoding.EncodeToString(newresponse.Dump())
 	}
 	data := gosaml.Formdata{WsFed: sRequest.Protocol == "wsfed", Acs: request.Query1(nil, "./@AssertionConsumerServiceURL"), Samlresponse: samlResponse, RelayState: relayState, Ard: template.JS(ardjson)}
-	return tmpl.ExecuteTemplate(w, "attributeReleaseForm", data)
+	return d.tmpl.ExecuteTemplate(w, "attributeReleaseForm", data)
+}
+
+// samlErrorResponse makes an unsigned error Response for err based on the response from the IdP.
+// Only the status and a sanitized message is sent - the details are in the log.
+func samlErrorResponse(err error, hubBirkIDPMd, spMd, request, response *goxml.Xp, id string) (newresponse *goxml.Xp) {
+	kind := kindOf(err)
+	status, ok := samlStatuses[kind]
+	if !ok {
+		status = samlStatuses[internalError]
+	}
+	newresponse = gosaml.NewErrorResponse(hubBirkIDPMd, spMd, request, response)
+	newresponse.Rm(nil, "./samlp:Status")
+	newresponse.QueryDashP(nil, "./samlp:Status/samlp:StatusCode/@Value", status[0], nil)
+	if status[1] != "" {
+		newresponse.QueryDashP(nil, "./samlp:Status/samlp:StatusCode/samlp:StatusCode/@Value", status[1], nil)
+	}
+	newresponse.QueryDashP(nil, "./samlp:Status/samlp:StatusMessage", errorMessages["en"][kind][0]+" - reference: "+id, nil)
+	return
+}
+
+// sendErrorResponse sends a signed error Response to the SP for err instead of showing the error page.
+func sendErrorResponse(w http.ResponseWriter, r *http.Request, err error, hubBirkIDPMd, spMd, request, response *goxml.Xp, relayState, signingMethod string) error {
+	newresponse := samlErrorResponse(err, hubBirkIDPMd, spMd, request, response, requestID(r))
+	if err := signResponse(newresponse, "/samlp:Response", hubBirkIDPMd, signingMethod, gosaml.SAMLSign); err != nil {
+		return err
+	}
+	dumpFileIfTracing(r, newresponse)
+
+	ardjson, err := json.Marshal(AttributeReleaseData{BypassConfirmation: true})
+	if err != nil {
+		return goxml.Wrap(err)
+	}
+	data := gosaml.Formdata{Acs: request.Query1(nil, "./@AssertionConsumerServiceURL"), Samlresponse: base64.StdEncoding.EncodeToString(newresponse.Dump()), RelayState: relayState, Ard: template.JS(ardjson)}
+	return deploymentFor(r).tmpl.ExecuteTemplate(w, "attributeReleaseForm", data)
 }
 
 // IDPSLOService refers to idp single logout service. Takes request as a parameter and returns an error if any
 func IDPSLOService(w http.ResponseWriter, r *http.Request) (err error) {
-	return SLOService(w, r, md.Internal, md.Hub, []gosaml.Md{md.ExternalSP, md.Hub}, []gosaml.Md{md.Internal, md.ExternalIDP}, gosaml.IDPRole, "SLO")
+	d := deploymentFor(r)
+	return SLOService(w, r, d.mdq.Internal, d.mdq.Hub, []gosaml.Md{d.mdq.ExternalSP, d.mdq.Hub}, []gosaml.Md{d.mdq.Internal, d.mdq.ExternalIDP}, gosaml.IDPRole, "SLO")
 }
 
 // SPSLOService refers to SP single logout service. Takes request as a parameter and returns an error if any
 func SPSLOService(w http.ResponseWriter, r *http.Request) (err error) {
-	return SLOService(w, r, md.Internal, md.Hub, []gosaml.Md{md.ExternalIDP, md.Hub}, []gosaml.Md{md.Internal, md.ExternalSP}, gosaml.SPRole, "SLO")
+	d := deploymentFor(r)
+	return SLOService(w, r, d.mdq.Internal, d.mdq.Hub, []gosaml.Md{d.mdq.ExternalIDP, d.mdq.Hub}, []gosaml.Md{d.mdq.Internal, d.mdq.ExternalSP}, gosaml.SPRole, "SLO")
 }
 
 // BirkSLOService refers to birk single logout service. Takes request as a parameter and returns an error if any
 func BirkSLOService(w http.ResponseWriter, r *http.Request) (err error) {
-	return SLOService(w, r, md.ExternalSP, md.ExternalIDP, []gosaml.Md{md.Hub}, []gosaml.Md{md.Internal}, gosaml.IDPRole, "SLO")
+	d := deploymentFor(r)
+	return SLOService(w, r, d.mdq.ExternalSP, d.mdq.ExternalIDP, []gosaml.Md{d.mdq.Hub}, []gosaml.Md{d.mdq.Internal}, gosaml.IDPRole, "SLO")
 }
 
 // KribSLOService refers to krib single logout service. Takes request as a parameter and returns an error if any
 func KribSLOService(w http.ResponseWriter, r *http.Request) (err error) {
-	return SLOService(w, r, md.ExternalIDP, md.ExternalSP, []gosaml.Md{md.Hub}, []gosaml.Md{md.Internal}, gosaml.SPRole, "SLO")
+	d := deploymentFor(r)
+	return SLOService(w, r, d.mdq.ExternalIDP, d.mdq.ExternalSP, []gosaml.Md{d.mdq.Hub}, []gosaml.Md{d.mdq.Internal}, gosaml.SPRole, "SLO")
 }
 
 func jwt2saml(w http.ResponseWriter, r *http.Request) (err error) {
-	hubMd, _ := md.Hub.MDQ(config.HubEntityID)
-	return gosaml.Jwt2saml(w, r, md.Hub, md.Internal, md.ExternalIDP, md.ExternalSP, RequestHandler, hubMd)
+	d := deploymentFor(r)
+	hubMd, _ := d.mdq.Hub.MDQ(d.HubEntityID)
+	return gosaml.Jwt2saml(w, r, d.mdq.Hub, d.mdq.Internal, d.mdq.ExternalIDP, d.mdq.ExternalSP, RequestHandler, hubMd)
 }
 
 func saml2jwt(w http.ResponseWriter, r *http.Request) (err error) {
-	return gosaml.Saml2jwt(w, r, md.Hub, md.Internal, md.ExternalIDP, md.ExternalSP, RequestHandler, config.HubEntityID, allowedDigestAndSignatureAlgorithms, xprefix+"SigningMethod")
+	d := deploymentFor(r)
+	// the SP is only limited once we know it - before that the client IP limit is all there is
+	spMd, _, err := gosaml.FindInMetadataSets(d.intExtSP, r.Header.Get("X-Issuer")+r.FormValue("issuer"))
+	if err != nil {
+		return
+	}
+	if err = limitSP(r, spMd.Query1(nil, "@entityID")); err != nil {
+		return
+	}
+	if relayState := r.FormValue("RelayState"); relayState != "" && r.Form.Get("SAMLResponse") != "" {
+		r.Form.Set("RelayState", stateFor(r).authnRequestCookie.resign("app", relayState))
+	}
+	return gosaml.Saml2jwt(w, r, d.mdq.Hub, d.mdq.Internal, d.mdq.ExternalIDP, d.mdq.ExternalSP, RequestHandler, d.HubEntityID, allowedDigestAndSignatureAlgorithms, xprefix+"SigningMethod")
 }
 
 // SLOService refers to single logout service. Takes request and issuer and destination metadata sets, role refers to if it as IDP or SP.
 func SLOService(w http.ResponseWriter, r *http.Request, issuerMdSet, destinationMdSet gosaml.Md, finalIssuerMdSets, finalDestinationMdSets []gosaml.Md, role int, tag string) (err error) {
+	d := deploymentFor(r)
 	defer r.Body.Close()
 	r.ParseForm()
 	request, _, destination, relayState, _, _, err := gosaml.ReceiveLogoutMessage(r, gosaml.MdSets{issuerMdSet}, gosaml.MdSets{destinationMdSet}, role)
 	if err != nil {
-		return err
+		return samlError(err)
 	}
 	var issMD, destMD, msg *goxml.Xp
 	var binding string
@@ -1264,6 +1540,8 @@ func SLOService(w http.ResponseWriter, r *http.Request, issuerMdSet, destination
 	if sloinfo == nil {
 		return fmt.Errorf("No SLO info found")
 	}
+	rec := logRecordFor(r)
+	rec.SP, rec.IdP = sloinfo.SP, sloinfo.IDP
 
 	if sendResponse && !ok {
 		return fmt.Errorf("SLO failed")
@@ -1325,20 +1603,19 @@ func SLOService(w http.ResponseWriter, r *http.Request, issuerMdSet, destination
 			return err
 		}
 		data := gosaml.Formdata{Acs: msg.Query1(nil, "./@Destination"), Samlresponse: base64.StdEncoding.EncodeToString(msg.Dump())}
-		return gosaml.PostForm.ExecuteTemplate(w, "postForm", data)
+		return d.tmpl.ExecuteTemplate(w, "postForm", data)
 	}
 	return
 }
 
 // SLOInfoHandler Saves or retrieves the SLO info relevant to the contents of the samlMessage
-// For now uses cookies to keep the SLOInfo
+// The SLOInfo is kept in the session
 func SLOInfoHandler(w http.ResponseWriter, r *http.Request, samlIn, idpMd, inMd, samlOut, outMd *goxml.Xp, role int, protocol string) (sil *gosaml.SLOInfoList, sloinfo *gosaml.SLOInfo, ok, sendResponse bool) {
-	sil = &gosaml.SLOInfoList{}
-	data, _ := session.Get(w, r, sloCookieName, sloInfoCookie)
-	sil.Unmarshal(data)
+	sil = loadSLOInfo(w, r)
 
 	switch samlIn.QueryString(nil, "local-name(/*)") {
 	case "LogoutRequest":
+		clearHubSSO(w, r)
 		sloinfo = sil.LogoutRequest(samlIn, inMd.Query1(nil, "@entityID"), uint8(role), protocol)
 		sendResponse = sloinfo.NameID == ""
 	case "LogoutResponse":
@@ -1349,20 +1626,16 @@ func SLOInfoHandler(w http.ResponseWriter, r *http.Request, samlIn, idpMd, inMd,
 		sil.Response(samlOut, outMd.Query1(nil, "@entityID"), outMd.Query1(nil, "./md:SPSSODescriptor/md:SingleLogoutService/@Location") != "", gosaml.IDPRole, protocol)
 	}
 	if sendResponse { // ready to send response - clear cookie
-		session.Del(w, r, sloCookieName, config.Domain, sloInfoCookie)
-	} else {
-		bytes := sil.Marshal()
-		session.Set(w, r, sloCookieName, config.Domain, bytes, sloInfoCookie, sloInfoTTL)
+		clearSLOInfo(w, r)
+	} else if err := saveSLOInfo(w, r, sil); err != nil {
+		logger.event(r, "sloinfo", map[string]string{"error": err.Error()})
 	}
 	return
 }
 
 // MDQWeb - thin MDQ web layer on top of lmdq
 func MDQWeb(w http.ResponseWriter, r *http.Request) (err error) {
-	if origin, ok := r.Header["Origin"]; ok {
-		w.Header().Add("Access-Control-Allow-Origin", origin[0])
-		w.Header().Add("Access-Control-Allow-Credentials", "true")
-	}
+	allowOrigin(w, r, nil)
 
 	var rawPath string
 	if rawPath = r.URL.RawPath; rawPath == "" {
@@ -1374,7 +1647,7 @@ func MDQWeb(w http.ResponseWriter, r *http.Request) (err error) {
 	var xp1, xp2 *goxml.Xp
 	switch len(path) {
 	case 3:
-		md, ok := webMdMap[path[1]]
+		md, ok := deploymentFor(r).webMdMap[path[1]]
 		if !ok {
 			return fmt.Errorf("Metadata set not found")
 		}
@@ -1384,6 +1657,7 @@ func MDQWeb(w http.ResponseWriter, r *http.Request) (err error) {
 		if err != nil {
 			return
 		}
+		allowOrigin(w, r, xp1)
 		if en1 == en2 { // hack to allow asking for a specific entity, by using the same entity twice
 			xp2, xml, err = md.md.WebMDQ(en2)
 		} else {
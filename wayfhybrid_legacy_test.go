@@ -0,0 +1,53 @@
+//go:build legacy
+// +build legacy
+
+// The examples in this file are the ones of the attribute helpers setAttribute, handleAttributeNameFormat and
+// debify. The helpers are not in this tree any more - Attributesc14n and CopyAttributes do their work - so the
+// examples are kept as they were and only build with the legacy tag.
+
+package wayfhybrid
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/wayf-dk/goxml"
+)
+
+func printHashedDom(xp *goxml.Xp) {
+	hash := sha1.Sum([]byte(xp.C14n(nil, "")))
+	fmt.Println(base64.StdEncoding.EncodeToString(append(hash[:])))
+}
+
+func ExampleSetAttribute() {
+	response := goxml.NewXpFromFile("testdata/sourceresponse_dtu.saml")
+	sourceAttributes := response.Query(nil, `/samlp:Response/saml:Assertion/saml:AttributeStatement`)[0]
+	setAttribute("schacHomeOrganization", "DEIC", response, sourceAttributes)
+	setAttribute("organizationName", "WAYF", response, sourceAttributes)
+	printHashedDom(response)
+	// Output:
+	// QCfnjgGL+fB96uZy93PgNybsmqM=
+}
+
+func ExampleHandleAttributeNameFormat() {
+	spMd := goxml.NewXpFromFile("testdata/sp_md.xml")
+	response := goxml.NewXpFromFile("testdata/sourceresponse_dtu.saml")
+	requestedAttr := goxml.NewXpFromFile("testdata/requestedattr.xml")
+	prepareTables(requestedAttr)
+	handleAttributeNameFormat(response, spMd)
+	// Output:
+	//
+}
+
+func ExampleDebify() {
+	fmt.Println(debify.ReplaceAllString("https://birk.wayf.dk/birk.php/example.com/test", "$1$2"))
+	fmt.Println(debify.ReplaceAllString("https://example.com/test", "$1$2"))
+	fmt.Println(debify.ReplaceAllString("urn:oid:1.3.6.1.4.1.39153:42:idp.entity.test", "$1$2"))
+	fmt.Println(debify.ReplaceAllString("idp.entity.test", "$1$2"))
+	// Output:
+	// https://example.com/test
+	// https://example.com/test
+	// idp.entity.test
+	// idp.entity.test
+}
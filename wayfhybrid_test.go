@@ -1,17 +1,42 @@
 package wayfhybrid
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"runtime"
 	"sort"
 	"strconv"
-	"testing"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/wayf-dk/goeleven/src/goeleven"
 	"github.com/wayf-dk/gosaml"
 	"github.com/wayf-dk/goxml"
 	"github.com/wayf-dk/lmdq"
@@ -21,27 +46,19 @@ var (
 	_ = log.Println
 )
 
-func TestMain(m *testing.M) {
-	Md.Hub = &lmdq.MDQ{Path: "file:testdata/test-metadata.mddb?mode=ro", Table: "HYBRID_HUB"}
-	Md.Internal = &lmdq.MDQ{Path: "file:testdata/test-metadata.mddb?mode=ro", Table: "HYBRID_INTERNAL"}
-	Md.ExternalIdP = &lmdq.MDQ{Path: "file:testdata/test-metadata.mddb?mode=ro", Table: "HYBRID_EXTERNAL_IDP"}
-	Md.ExternalSP = &lmdq.MDQ{Path: "file:testdata/test-metadata.mddb?mode=ro", Table: "HYBRID_EXTERNAL_SP"}
+const testAuthnRequest = `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_req"><saml:Issuer>https://sp.example.org</saml:Issuer></samlp:AuthnRequest>`
 
-	for _, md := range []gosaml.Md{Md.Hub, Md.Internal, Md.ExternalIdP, Md.ExternalSP} {
-		err := md.(*lmdq.MDQ).Open()
-		if err != nil {
-			panic(err)
-		}
+// rmNameID removes the nameID attribute - it is a new transient id for each response
+func rmNameID(response *goxml.Xp) {
+	for _, attr := range response.Query(nil, "//saml:Attribute[@Name='nameID']") {
+		goxml.RmElement(attr)
 	}
-	os.Exit(m.Run())
 }
 
-func printHashedDom(xp *goxml.Xp) {
-	hash := sha1.Sum([]byte(xp.C14n(nil, "")))
-	fmt.Println(base64.StdEncoding.EncodeToString(append(hash[:])))
-}
-
-func scopeCheckTest(scopes [][]string, reqEppn bool) {
+// scopeCheckTest prints what the scope checks see for each of scopes - the eppn, the eppn the eptid is made from,
+// the security domain and the scoped affiliations the IdP sent - and the result of wayfScopeCheck
+func scopeCheckTest(scopes [][]string) {
+	spMd := goxml.NewXpFromFile("testdata/sp_md.xml")
 	for _, scope := range scopes {
 		response := goxml.NewXpFromFile("testdata/sourceresponse_dtu.saml")
 		scopeList := goxml.NewXpFromFile("testdata/scope.xml")
@@ -57,21 +74,36 @@ func scopeCheckTest(scopes [][]string, reqEppn bool) {
 		for i, j := range scope[2:] {
 			response.QueryDashP(exttest, `/saml:Attribute[@FriendlyName='eduPersonScopedAffiliation']/saml:AttributeValue[`+strconv.Itoa(i+1)+`]`, j, nil)
 		}
+		eppsas := response.QueryMulti(exttest, "saml:Attribute[@FriendlyName='eduPersonScopedAffiliation']/saml:AttributeValue")
 
-		attrNode := response.Query(nil, `/samlp:Response/saml:Assertion/saml:AttributeStatement`)[0]
-		eppn, eppnForEptid, securitydomain, eppsas, err := checkScope(response, scopeList, attrNode, reqEppn) // "saml:Attribute[@Name='eduPersonPrincipalName']/saml:AttributeValue")
-		fmt.Println(eppn, eppnForEptid, securitydomain, eppsas, err)
+		Attributesc14n(goxml.NewXpFromString(testAuthnRequest), response, scopeList, spMd)
+		as := response.Query(nil, "./saml:Assertion/saml:AttributeStatement")[0]
+		eppn := response.Query1(as, "saml:Attribute[@Name='eduPersonPrincipalName']/saml:AttributeValue")
+		eppnForEptid := response.Query1(as, "saml:Attribute[@Name='persistent']/saml:AttributeValue")
+		if eppnForEptid == "" {
+			eppnForEptid = eppn
+		}
+		securitydomain := response.Query1(as, "saml:Attribute[@Name='subsecuritydomain']/saml:AttributeValue")
+		fmt.Println(eppn, eppnForEptid, securitydomain, eppsas, wayfScopeCheck(response, scopeList))
 	}
 }
 
-func ExampleCheckScope() {
+// Example_checkScope runs the scope checks with the cases the removed checkScope was tested with. wayfScopeCheck has
+// replaced it and these lines differ from what checkScope gave:
+//   - an eppn is required for all logins - the 4th case and the last 3 stop at "isRequired: eduPersonPrincipalName"
+//     where checkScope without reqEppn went on to the scopes
+//   - without an eppn the sub security domain is the domain of the first scoped affiliation - aau.dk in those cases
+//   - scoped affiliations in a sub domain of the sub security domain are accepted for all logins, so staff@zzz.aau.dk
+//     passes in the 6th case and the 10th says "security sub domain"
+//   - an eppn with two @s is not a scoped value - the 9th case stops there and has no security domain
+func Example_checkScope() {
 	scopesEppn := [][]string{
 		{"mekhan@aau.dk", "aau.dk", "staff@aau.dk", "staff@zzz.aau.dk", "staff@xxx.aau.dk"},
 		{"mh@sikker-adgang.dk", "sikker-adgang.dk", "staff@adgang.dk"},
 		{"xx@alumne.ku.dk", "alumne.ku.dk", "student@ku.dk"},
 		{"\x1b", "dtu.dk", "staff@aau.dk"},
 	}
-	scopeCheckTest(scopesEppn, true)
+	scopeCheckTest(scopesEppn)
 
 	scopes := [][]string{
 		{"mekhan@aau.dk", "dtu.dk", "staff@aau.dk", "staff@zzz.aau.dk", "staff@xxx.aau.dk"},
@@ -84,41 +116,46 @@ func ExampleCheckScope() {
 		{"\x1b", "aau.dk", "staff@aau.dk", "member@aau.dk"},
 		{"\x1b", "dtu.dk", "staff@aau.dk"},
 	}
-	scopeCheckTest(scopes, false)
+	scopeCheckTest(scopes)
 	// Output:
 	// mekhan@aau.dk mekhan@aau.dk aau.dk [staff@aau.dk staff@zzz.aau.dk staff@xxx.aau.dk] <nil>
 	// mh@sikker-adgang.dk mh@sikker-adgang.dk sikker-adgang.dk [staff@adgang.dk] eduPersonScopedAffiliation: staff@adgang.dk has not 'sikker-adgang.dk' as security sub domain
 	// xx@alumne.ku.dk xx@alumne.ku.dk ku.dk [student@ku.dk] <nil>
-	//    [staff@aau.dk] Mandatory 'eduPersonPrincipalName' attribute missing
+	//   aau.dk [staff@aau.dk] isRequired: eduPersonPrincipalName
 	// mekhan@aau.dk mekhan@aau.dk aau.dk [staff@aau.dk staff@zzz.aau.dk staff@xxx.aau.dk] security domain 'aau.dk' does not match any scopes
-	// mekhan@aau.dk mekhan@aau.dk aau.dk [staff@aau.dk staff@zzz.aau.dk staff@xxx.aau.dk] eduPersonScopedAffiliation: staff@zzz.aau.dk has not 'aau.dk' as security domain
+	// mekhan@aau.dk mekhan@aau.dk aau.dk [staff@aau.dk staff@zzz.aau.dk staff@xxx.aau.dk] <nil>
 	// mh@kmduni.dans.kmd.dk mh@kmduni.dans.kmd.dk kmduni.dans.kmd.dk [staff@kmduni.dans.kmd.dk] <nil>
 	// mh@sikker-adgang.dk mh@sikker-adgang.dk sikker-adgang.dk [sdu.dk staff@sikker-adgang.dk] eduPersonScopedAffiliation: sdu.dk does not end with a domain
-	// mekhan@student.aau.dk@aau.dk mekhan@student.aau.dk@aau.dk aau.dk@aau.dk [sdu.dk orphanage.wayf.dk plan.aau.dk@aau.dk] eduPersonScopedAffiliation: sdu.dk does not end with a domain
-	// mh@sikker-adgang.dk mh@sikker-adgang.dk sikker-adgang.dk [staff@adgang.dk] eduPersonScopedAffiliation: staff@adgang.dk has not 'sikker-adgang.dk' as security domain
-	//   aau.dk [staff@aau.dk] <nil>
-	//   aau.dk [staff@aau.dk member@aau.dk] <nil>
-	//   aau.dk [staff@aau.dk] security domain 'aau.dk' does not match any scopes
+	// mekhan@student.aau.dk@aau.dk mekhan@student.aau.dk@aau.dk  [sdu.dk orphanage.wayf.dk plan.aau.dk@aau.dk] not a scoped value: mekhan@student.aau.dk@aau.dk
+	// mh@sikker-adgang.dk mh@sikker-adgang.dk sikker-adgang.dk [staff@adgang.dk] eduPersonScopedAffiliation: staff@adgang.dk has not 'sikker-adgang.dk' as security sub domain
+	//   aau.dk [staff@aau.dk] isRequired: eduPersonPrincipalName
+	//   aau.dk [staff@aau.dk member@aau.dk] isRequired: eduPersonPrincipalName
+	//   aau.dk [staff@aau.dk] isRequired: eduPersonPrincipalName
 }
 
 /**
-  ExampleNewMetadata tests that the lock preventing race conditions when
+  Example_newMetadata tests that the lock preventing race conditions when
   opening and using a mddb works. In real life we (re-)open a mddb file with the
   same name (but hopefully with updated metadata).
 */
-func ExampleNewMetadata() {
+func Example_newMetadata() {
 	onetwo := map[string]bool{}
 	finish := make(chan bool)
 	mdset := &lmdq.MDQ{Path: "file:testdata/one.mddb?mode=ro", Table: "wayf_hub_base"}
 	mdset.Open()
+	started := make(chan bool, 1)
 	go func() {
-		for range [1000]int{} {
+		for !onetwo["two"] {
 			md, _ := mdset.MDQ("https://wayf.wayf.dk")
 			onetwo[md.Query1(nil, "//wayf:phphfeed")] = true
+			select {
+			case started <- true:
+			default:
+			}
 		}
 		finish <- true
 	}()
-	time.Sleep(1 * time.Millisecond)
+	<-started
 	mdset.Path = "file:testdata/two.mddb?mode=ro"
 	mdset.Open()
 	<-finish
@@ -138,7 +175,7 @@ func ExampleNewMetadata() {
 	// two true
 }
 
-func ExampleCheckCprCentury() {
+func Example_checkCprCentury() {
 	testData := [][]int{
 		{88, 0},
 		{58, 1},
@@ -182,20 +219,24 @@ func ExampleCheckCprCentury() {
 	// 1937
 }
 
-func ExampleCopyAttributes() {
+// Example_copyAttributes copies the attributes of a handled response as the hub does. The values are the ones
+// ExampleCopyAttributes had, but CopyAttributes now releases what sp_md.xml requests in the name and format it
+// requests: cn as basic, displayName without a NameFormat and norEduPersonNIN, which c14n makes from the
+// schacPersonalUniqueID.
+func Example_copyAttributes() {
 	idpMd := goxml.NewXpFromFile("testdata/idp_md_dtu.xml")
 	hubMd := goxml.NewXpFromFile("testdata/hub_md.xml")
 	spMd := goxml.NewXpFromFile("testdata/sp_md.xml")
-	prepareTables(hubMd)
 	sourceResponse := goxml.NewXpFromFile("testdata/sourceresponse_dtu.saml")
-	WayfACSServiceHandler(idpMd, hubMd, spMd, nil, sourceResponse.CpXp(), false)
+	Attributesc14n(goxml.NewXpFromString(testAuthnRequest), sourceResponse, idpMd, spMd)
+	wayfACSServiceHandler(httptest.NewRequest("GET", "/", nil), idpMd, hubMd, spMd, nil, sourceResponse, false)
 	newresponse := gosaml.NewResponse(idpMd, spMd, sourceResponse, sourceResponse)
-	CopyAttributes(sourceResponse, newresponse, spMd)
+	CopyAttributes(sourceResponse, newresponse, idpMd, spMd)
 	gosaml.AttributeCanonicalDump(os.Stdout, newresponse)
 	// Output:
-	// cn urn:oid:2.5.4.3 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// cn urn:oasis:names:tc:SAML:2.0:attrname-format:basic
 	//     Mads Freek Petersen
-	// displayName urn:oid:2.16.840.1.113730.3.1.241 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// displayName urn:oid:2.16.840.1.113730.3.1.241
 	//     Mads Freek Petersen
 	// eduPersonAssurance urn:oid:1.3.6.1.4.1.5923.1.1.1.11 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
 	//     2
@@ -219,6 +260,8 @@ func ExampleCopyAttributes() {
 	//     Mads Freek
 	// mail urn:oid:0.9.2342.19200300.100.1.3 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
 	//     madpe@dtu.dk
+	// norEduPersonNIN urn:oid:1.3.6.1.4.1.2428.90.1.5 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	//     2408588834
 	// organizationName urn:oid:2.5.4.10 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
 	//     Danmarks Tekniske Universitet
 	// preferredLanguage urn:oid:2.16.840.1.113730.3.1.39 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
@@ -237,136 +280,195 @@ func ExampleCopyAttributes() {
 	//     Petersen
 }
 
-func ExampleWayfAttributeHandler() {
+// Example_wayfAttributeHandler dumps a response after Attributesc14n and the WAYF attribute handler. The handler
+// now works on the canonical attributes - short names without a NameFormat - so the lines name the attributes that
+// way and include the internal ones the handler adds (idpID, spfeds, securitydomain ...). The values of the
+// attributes ExampleWayfAttributeHandler printed are unchanged.
+func Example_wayfAttributeHandler() {
 	idpMd := goxml.NewXpFromFile("testdata/idp_md_dtu.xml")
 	hubMd := goxml.NewXpFromFile("testdata/hub_md.xml")
 	spMd := goxml.NewXpFromFile("testdata/sp_md.xml")
-	prepareTables(hubMd)
 	sourceResponse := goxml.NewXpFromFile("testdata/sourceresponse_dtu.saml")
 	for i := 0; i < 1; i++ {
 		for j := 0; j < 1; j++ {
-			WayfACSServiceHandler(idpMd, hubMd, spMd, nil, sourceResponse.CpXp(), false)
-			gosaml.AttributeCanonicalDump(os.Stdout, sourceResponse)
+			response := sourceResponse.CpXp()
+			Attributesc14n(goxml.NewXpFromString(testAuthnRequest), response, idpMd, spMd)
+			wayfACSServiceHandler(httptest.NewRequest("GET", "/", nil), idpMd, hubMd, spMd, nil, response, false)
+			rmNameID(response)
+			gosaml.AttributeCanonicalDump(os.Stdout, response)
 		}
 		//        log.Println(i)
 		//        runtime.GC()
 		//        PrintMemUsage()
 	}
 	// Output:
-	// cn urn:oid:2.5.4.3 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// AuthnContextClassRef
+	//     urn:oasis:names:tc:SAML:2.0:ac:classes:Password
+	// Issuer
+	//     https://wayf.ait.dtu.dk/saml2/idp/metadata.php
+	// cn
 	//     Mads Freek Petersen
-	// displayName urn:oid:2.16.840.1.113730.3.1.241 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// commonfederations
+	//     true
+	// displayName
 	//     Mads Freek Petersen
-	// eduPersonAffiliation urn:oid:1.3.6.1.4.1.5923.1.1.1.1 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// eduPersonAffiliation
 	//     member
 	//     staff
-	// eduPersonAssurance urn:oid:1.3.6.1.4.1.5923.1.1.1.11 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// eduPersonAssurance
 	//     2
-	// eduPersonEntitlement urn:oid:1.3.6.1.4.1.5923.1.1.1.7 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// eduPersonEntitlement
 	//     this is not an allowed value
 	//     this.is.a.prefix.with.an.allowed.postfix
 	//     this.is.an.allowed.infix.with.a.postfix
 	//     this.is.an.allowed.prefix.with.a.postfix
 	//     this.is.an.allowed.regexp.with.a.postfix
 	//     urn:mace:terena.org:tcs:escience-user
-	// eduPersonPrimaryAffiliation urn:oid:1.3.6.1.4.1.5923.1.1.1.5 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// eduPersonPrimaryAffiliation
 	//     staff
-	// eduPersonPrincipalName urn:oid:1.3.6.1.4.1.5923.1.1.1.6 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// eduPersonPrincipalName
 	//     madpe@dtu.dk
-	// eduPersonScopedAffiliation urn:oid:1.3.6.1.4.1.5923.1.1.1.9 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// eduPersonScopedAffiliation
 	//     member@dtu.dk
 	//     staff@dtu.dk
 	//     staff@just.testing.dtu.dk
-	// eduPersonTargetedID urn:oid:1.3.6.1.4.1.5923.1.1.1.10 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// eduPersonTargetedID
 	//     WAYF-DK-9c03f6bdabf9e280d9dfdedb42ebaf161c30ed51
-	// gn urn:oid:2.5.4.42 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// gn
 	//     Mads Freek
-	// mail urn:oid:0.9.2342.19200300.100.1.3 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// hub
+	//     false
+	// idpID
+	//     https://wayf.ait.dtu.dk/saml2/idp/metadata.php
+	// idpfeds
+	//     WAYF
+	// mail
 	//     madpe@dtu.dk
-	// organizationName urn:oid:2.5.4.10 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// modstlogonmethod
+	//     username-password-protected-transport
+	// nemlogin
+	//     false
+	// norEduPersonNIN
+	//     2408588834
+	// oioCvrNumberIdentifier
+	// organizationName
 	//     Danmarks Tekniske Universitet
-	// preferredLanguage urn:oid:2.16.840.1.113730.3.1.39 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// pairwise-id
+	// persistent
+	// preferredLanguage
 	//     da-DK
-	// schacDateOfBirth urn:oid:1.3.6.1.4.1.25178.1.2.3 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// schacDateOfBirth
 	//     18580824
-	// schacHomeOrganization urn:oid:1.3.6.1.4.1.25178.1.2.9 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// schacHomeOrganization
 	//     dtu.dk
-	// schacHomeOrganizationType urn:oid:1.3.6.1.4.1.25178.1.2.10 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// schacHomeOrganizationType
 	//     urn:mace:terena.org:schac:homeOrganizationType:eu:higherEducationalInstitution
-	// schacPersonalUniqueID urn:oid:1.3.6.1.4.1.25178.1.2.15 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// schacPersonalUniqueID
 	//     urn:mace:terena.org:schac:personalUniqueID:dk:CPR:2408588834
-	// schacYearOfBirth urn:oid:1.3.6.1.4.1.25178.1.0.2.3 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// schacYearOfBirth
 	//     1858
-	// sn urn:oid:2.5.4.4 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// securitydomain
+	//     dtu.dk
+	// sn
 	//     Petersen
+	// spID
+	//     https://wayfsp.wayf.dk
+	// spfeds
+	//     WAYF
+	//     nemlog-in.dk
+	// subsecuritydomain
+	//     dtu.dk
+	// uid
+	//     madpe
 }
 
-func ExampleNemLoginAttributeHandler() {
+// Example_nemLoginAttributeHandler dumps a NemLog-in response after Attributesc14n and the WAYF attribute handler.
+// As in Example_wayfAttributeHandler the attributes are canonical, so the NemLog-in attributes are mapped to WAYF
+// names instead of being appended next to them - the duplicated eppn, gn and sn and the basic NemLog-in names of
+// ExampleNemLoginAttributeHandler are gone. The response is from before NemLog-in base64 encoded the attribute
+// values, so base64attributes is turned off in its metadata.
+func Example_nemLoginAttributeHandler() {
 	nemloginResponse := goxml.NewXpFromFile("testdata/nemloginresponse.xml")
 	idpMd := goxml.NewXpFromFile("testdata/idp_md_nemlogin.xml")
 	hubMd := goxml.NewXpFromFile("testdata/hub_md.xml")
 	spMd := goxml.NewXpFromFile("testdata/sp_md.xml")
-	prepareTables(hubMd)
+	idpMd.QueryDashP(nil, "./md:Extensions/wayf:wayf/wayf:base64attributes", "0", nil) // the response is from before nemlogin base64 encoded the attributes
 
-	WayfACSServiceHandler(idpMd, hubMd, spMd, nil, nemloginResponse, false)
+	Attributesc14n(goxml.NewXpFromString(testAuthnRequest), nemloginResponse, idpMd, spMd)
+	wayfACSServiceHandler(httptest.NewRequest("GET", "/", nil), idpMd, hubMd, spMd, nil, nemloginResponse, false)
+	rmNameID(nemloginResponse)
 
 	gosaml.AttributeCanonicalDump(os.Stdout, nemloginResponse)
 	// Output:
-	// cn urn:oid:2.5.4.3 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// AuthnContextClassRef
+	// Issuer
+	//     https://saml.nemlog-in.dk
+	// cn
 	//     Anton Banton Cantonsen
-	// dk:gov:saml:attribute:AssuranceLevel urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     3
-	// dk:gov:saml:attribute:CprNumberIdentifier urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     2408588234
-	// dk:gov:saml:attribute:PidNumberIdentifier urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     9208-2002-2-941238474441
-	// dk:nemlogin:saml:attribute:IdPSessionIndex urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     8D-54-F1-F9-AD-67-D8-65-6D-5A-58-AD-9F-F2-E7-92-5E-72-82-62
-	// eduPersonAssurance urn:oid:1.3.6.1.4.1.5923.1.1.1.11 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
-	//     3
-	// eduPersonPrimaryAffiliation urn:oid:1.3.6.1.4.1.5923.1.1.1.5 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// commonfederations
+	//     true
+	// displayName
+	//     Anton Banton Cantonsen
+	// eduPersonAffiliation
 	//     member
-	// eduPersonPrimaryAffiliation urn:oid:1.3.6.1.4.1.5923.1.1.1.5 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// eduPersonAssurance
+	//     3
+	// eduPersonPrimaryAffiliation
 	//     member
-	// eduPersonPrincipalName urn:oid:1.3.6.1.4.1.5923.1.1.1.6 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
-	//     PID:5666-1234-2-529868547821@sikker-adgang.dk
-	// eduPersonPrincipalName urn:oid:1.3.6.1.4.1.5923.1.1.1.6 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// eduPersonPrincipalName
+	//     PID:5666-1234-2-529868547821
 	//     PID:5666-1234-2-529868547821@sikker-adgang.dk
-	// gn urn:oid:2.5.4.42 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// eduPersonScopedAffiliation
+	//     member@sikker-adgang.dk
+	// eduPersonTargetedID
+	//     WAYF-DK-05fbae29417a1647eaae8708fb7a389eac0a52f9
+	// gn
 	//     Anton Banton
-	// gn urn:oid:2.5.4.42 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
-	//     Anton Banton
-	// http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     someone@example.com
-	// http://schemas.xmlsoap.org/ws/2005/05/identity/claims/givenname urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     CN=Anton Banon Cantonsen + SERIALNUMBER=PID:5666-1234-2-529868547821, O=Ingen organisatorisk tilknytning, C=DK
-	// mail urn:oid:0.9.2342.19200300.100.1.3 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// hub
+	//     false
+	// idpID
+	//     https://birk.wayf.dk/birk.php/nemlogin.wayf.dk
+	// idpfeds
+	//     nemlog-in.dk
+	// mail
 	//     someone@example.com
-	// organizationName urn:oid:2.5.4.10 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
-	//     Ingen organisatorisk tilknytning
-	//     NemLogin
-	// schacPersonalUniqueID urn:oid:1.3.6.1.4.1.25178.1.2.15 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// modstlogonmethod
+	//     username-password-protected-transport
+	// nemlogin
+	//     true
+	// norEduPersonNIN
+	//     2408588234
+	// oioCvrNumberIdentifier
+	// organizationName
+	//     NemLog-in
+	// pairwise-id
+	// persistent
+	// schacDateOfBirth
+	//     18580824
+	// schacHomeOrganization
+	//     sikker-adgang.dk
+	// schacHomeOrganizationType
+	//     urn:mace:terena.org:schac:homeOrganizationType:int:other
+	// schacPersonalUniqueID
 	//     urn:mace:terena.org:schac:personalUniqueID:dk:CPR:2408588234
-	// sn urn:oid:2.5.4.4 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
-	//     Cantonsen
-	// sn urn:oid:2.5.4.4 urn:oasis:names:tc:SAML:2.0:attrname-format:uri
+	// schacYearOfBirth
+	//     1858
+	// securitydomain
+	//     sikker-adgang.dk
+	// sn
 	//     Cantonsen
-	// urn:oid:0.9.2342.19200300.100.1.1 urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     PID:5666-1234-2-529868547821
+	// spID
+	//     https://wayfsp.wayf.dk
+	// spfeds
+	//     WAYF
+	//     nemlog-in.dk
+	// subsecuritydomain
+	//     sikker-adgang.dk
+	// uid
 	//     PID:5666-1234-2-529868547821
-	// urn:oid:0.9.2342.19200300.100.1.3 urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     someone@example.com
-	// urn:oid:1.3.6.1.4.1.1466.115.121.1.8 urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     MIIGJzCCBQ+gAwIBAgIEU5tM2jANBgkqhkiG9w0BAQsFADBAMQswCQYDVQQGEwJESzESMBAGA1UECgwJVFJVU1QyNDA4MR0wGwYDVQQDDBRUUlVTVDI0MDggT0NFUyBDQSBJSTAeFw0xNTAzMDUyMTM0MzBaFw0xODAzMDUyMjA0MzBaMHsxCzAJBgNVBAYTAkRLMSkwJwYDVQQKDCBJbmdlbiBvcmdhbmlzYXRvcmlzayB0aWxrbnl0bmluZzFBMBoGA1UEAwwTTWFkcyBGcmVlayBQZXRlcnNlbjAjBgNVBAUTHFBJRDo5MjA4LTIwMDItMi05NDEyMzg0NzQ0NDEwggEiMA0GCSqGSIb3DQEBAQUAA4IBDwAwggEKAoIBAQCpwOBDqp1ntMDc7Zib5gtqpg7BzH2Pit/5qIgX/pGWLzaqwnYxtrJH2GFWsQPNBxCozWYS3ecJoGvsJLjfE88zaOqU0dZruSJAE8B2LNTp9Yo1hNPXIug6dhCWrLaOLqHCyyjvv9eXixZTPk9O6+4YLmxwKTMWhVOHiFCDc6ZBQxAytow7uWN76hM1KDXVEEPF8I1wFsFHBxM/VhAk2KHdvCISImOv4aAfX3ravAJiEPBTag1mSkn/zFTHkPms2RQGMjYsOJ2UG6MhxFHgJ1ufHN+MoiVfXN2m2RHmlz7P4/WcZduF6ZH7GdHr3FI0POC/ARNYV/JEZIblB4Tb0uJtAgMBAAGjggLsMIIC6DAOBgNVHQ8BAf8EBAMCA/gwgYcGCCsGAQUFBwEBBHsweTA1BggrBgEFBQcwAYYpaHR0cDovL29jc3AuaWNhMDIudHJ1c3QyNDA4LmNvbS9yZXNwb25kZXIwQAYIKwYBBQUHMAKGNGh0dHA6Ly9haWEuaWNhMDIudHJ1c3QyNDA4LmNvbS9vY2VzLWlzc3VpbmcwMi1jYS5jZXIwggFDBgNVHSAEggE6MIIBNjCCATIGCiqBUIEpAQEBAQQwggEiMC8GCCsGAQUFBwIBFiNodHRwOi8vd3d3LnRydXN0MjQwOC5jb20vcmVwb3NpdG9yeTCB7gYIKwYBBQUHAgIwgeEwEBYJVFJVU1QyNDA4MAMCAQEagcxGb3IgYW52ZW5kZWxzZSBhZiBjZXJ0aWZpa2F0ZXQgZ+ZsZGVyIE9DRVMgdmlsa+VyLCBDUFMgb2cgT0NFUyBDUCwgZGVyIGthbiBoZW50ZXMgZnJhIHd3dy50cnVzdDI0MDguY29tL3JlcG9zaXRvcnkuIEJlbeZyaywgYXQgVFJVU1QyNDA4IGVmdGVyIHZpbGvlcmVuZSBoYXIgZXQgYmVncuZuc2V0IGFuc3ZhciBpZnQuIHByb2Zlc3Npb25lbGxlIHBhcnRlci4wIAYDVR0RBBkwF4EVbWFkc0BmcmVla3BldGVyc2VuLmRrMIGXBgNVHR8EgY8wgYwwLqAsoCqGKGh0dHA6Ly9jcmwuaWNhMDIudHJ1c3QyNDA4LmNvbS9pY2EwMi5jcmwwWqBYoFakVDBSMQswCQYDVQQGEwJESzESMBAGA1UECgwJVFJVU1QyNDA4MR0wGwYDVQQDDBRUUlVTVDI0MDggT0NFUyBDQSBJSTEQMA4GA1UEAwwHQ1JMMTczNTAfBgNVHSMEGDAWgBSZj7oNia4hGkJ6Cq4aTE4i/xDrjDAdBgNVHQ4EFgQULCZ5KBGm0pSBA1TW5odrI3igYO0wCQYDVR0TBAIwADANBgkqhkiG9w0BAQsFAAOCAQEABHmiC28GMHFGsego/hFJwontUzbP8DLFfnQYMMg7a/WAxfrUAiBmdJBtHkHgvLRHwSSAz4UT1C/Kkt+N858B+x9LGt+zGEBPkE6bpNt0VbVywDjk+RJi+cHba70s7ZteL7R0hIYUBEEfvDRpJhWhCB1tWAxfNnc3g7MywL5YRACnL4d/fXBpTn60z1D+ltZb5XihL8tPATPCOC4tjwTJ+BxtNxfnOzzeS14uObgenV0gA8qNwcxJhrxZlb/XwhnKPUVGRryJ+H1OFrB2Olam+EDC+SPeLpgid4abZNoxh5ZXKmC08hiZeIozqlbE5z2JBckRT8cfKriO8cLRSZReSw==
-	// urn:oid:2.5.29.29 urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     CN=TRUST2408 OCES CA II, O=TRUST2408, C=DK
-	// urn:oid:2.5.4.3 urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     Anton Banton Cantonsen
-	// urn:oid:2.5.4.5 urn:oasis:names:tc:SAML:2.0:attrname-format:basic
-	//     539B4CDA
 }
 
-func ExampleSamlError() {
+func Example_samlError() {
 	nemloginResponse := goxml.NewXpFromFile("testdata/samlerror.xml")
 	fmt.Println(nemloginResponse.PP())
 	// Output:
@@ -391,55 +493,1546 @@ func ExampleSamlError() {
 	// </samlp:Response>
 }
 
-func ExampleCheckForCommonFederations() {
+func Example_checkForCommonFederations() {
 	idpMd := goxml.NewXpFromFile("testdata/idp_md_dtu.xml")
 	spMd := goxml.NewXpFromFile("testdata/sp_md.xml")
-	err := checkForCommonFederations(idpMd, spMd)
+	request := goxml.NewXpFromString(testAuthnRequest)
+	_, err := RequestHandler(request, idpMd, spMd)
 	fmt.Println(err)
 	// Output:
 	// <nil>
 }
 
-func ExampleNoCommonFederations() {
+func Example_noCommonFederations() {
 	idpMd := goxml.NewXpFromFile("testdata/idp_md_dtu.xml")
 	spMd := goxml.NewXpFromFile("testdata/sp_md.xml")
 	spMd.QueryDashP(nil, "./md:Extensions/wayf:wayf/wayf:feds", "ExampleFed", nil)
-	err := checkForCommonFederations(idpMd, spMd)
+	request := goxml.NewXpFromString(testAuthnRequest)
+	_, err := RequestHandler(request, idpMd, spMd)
 	fmt.Println(err)
 	// Output:
 	// no common federations
 }
 
-func ExampleSetAttribute() {
-	response := goxml.NewXpFromFile("testdata/sourceresponse_dtu.saml")
-	sourceAttributes := response.Query(nil, `/samlp:Response/saml:Assertion/saml:AttributeStatement`)[0]
-	setAttribute("schacHomeOrganization", "DEIC", response, sourceAttributes)
-	setAttribute("organizationName", "WAYF", response, sourceAttributes)
-	printHashedDom(response)
+// Example_overrideConfig shows the precedence: WAYF_<NAME> over WAYF_<NAME>_FILE over the toml config
+func Example_overrideConfig() {
+	secret, _ := ioutil.TempFile("", "secret")
+	secret.WriteString("fromfile\n")
+	secret.Close()
+	defer os.Remove(secret.Name())
+
+	env := map[string]string{
+		"WAYF_EPTIDSALT":              "fromenv",
+		"WAYF_EPTIDSALT_FILE":         secret.Name(),
+		"WAYF_SALTFORHASHEDEPPN_FILE": secret.Name(),
+		"WAYF_HUB_PATH":               "hub.mddb",
+		"WAYF_ELEMENTSTOSIGN":         "/samlp:Response, /samlp:Response/saml:Assertion",
+		"WAYF_METADATAFEEDS":          `[{"Path": "hub.mddb", "URL": "https://md.example.com/hub.mddb"}]`,
+		"WAYF_SLOTPASSWORD":           "legacy",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	conf := Conf{EptidSalt: "fromtoml", Domain: "fromtoml"}
+	sources, err := overrideConfig(&conf)
+	fmt.Println(conf.EptidSalt, conf.SaltForHashedEppn, conf.Domain, conf.Hub.Path, conf.ElementsToSign, conf.MetadataFeeds, conf.GoEleven.SlotPassword, err)
+	for _, s := range sources {
+		if s.source != "toml" || s.name == "Domain" {
+			fmt.Println(s.name, s.value, strings.Replace(s.source, secret.Name(), "secret", 1))
+		}
+	}
 	// Output:
-	// QCfnjgGL+fB96uZy93PgNybsmqM=
+	// fromenv fromfile fromtoml hub.mddb [/samlp:Response /samlp:Response/saml:Assertion] [{hub.mddb https://md.example.com/hub.mddb}] legacy <nil>
+	// Domain fromtoml toml
+	// EptidSalt ******** env WAYF_EPTIDSALT
+	// SaltForHashedEppn ******** file secret
+	// ElementsToSign [/samlp:Response /samlp:Response/saml:Assertion] env WAYF_ELEMENTSTOSIGN
+	// Hub.Path hub.mddb env WAYF_HUB_PATH
+	// MetadataFeeds [{hub.mddb https://md.example.com/hub.mddb}] env WAYF_METADATAFEEDS
+	// GoEleven.SlotPassword ******** env WAYF_SLOTPASSWORD
 }
 
-func ExampleHandleAttributeNameFormat() {
-	spMd := goxml.NewXpFromFile("testdata/sp_md.xml")
-	response := goxml.NewXpFromFile("testdata/sourceresponse_dtu.saml")
-	requestedAttr := goxml.NewXpFromFile("testdata/requestedattr.xml")
-	prepareTables(requestedAttr)
-	handleAttributeNameFormat(response, spMd)
+// Example_cookieKeyRing shows that cookies signed with older keys are accepted after a new key is added
+func Example_cookieKeyRing() {
+	conf := Conf{SecureCookieHashKey: "00112233"}
+	legacy, _ := newCookieKeyRing(conf, "test", 60)
+	legacyCookie, _ := legacy.Encode("SLO", []byte("legacy"))
+
+	conf.CookieKeys = []struct{ ID, Key string }{{"k1", "44556677"}}
+	k1, _ := newCookieKeyRing(conf, "test", 60)
+	k1Cookie, _ := k1.Encode("SLO", []byte("k1"))
+
+	conf.CookieKeys = append(conf.CookieKeys, struct{ ID, Key string }{"k2", "8899aabb"})
+	k2, _ := newCookieKeyRing(conf, "test", 60)
+	k2Cookie, _ := k2.Encode("SLO", []byte("k2"))
+
+	for _, cookie := range []string{legacyCookie, k1Cookie, k2Cookie} {
+		msg, err := k2.Decode("SLO", cookie)
+		fmt.Println(strings.SplitN(cookie, ".", 2)[0] == cookie, string(msg), err)
+	}
+	_, err := k1.Decode("SLO", k2Cookie)
+	fmt.Println(err)
+	for _, cookie := range []string{"", "k2.", "k2.c2hvcnQ"} {
+		_, err := k2.Decode("SLO", cookie)
+		fmt.Println(err)
+	}
+	// Output:
+	// true legacy <nil>
+	// false k1 <nil>
+	// false k2 <nil>
+	// ["cookie signed with unknown key","key:k2"]
+	// ["cookie too short"]
+	// ["cookie too short"]
+	// ["cookie too short"]
+}
+
+// Example_cookieKeyRingResign shows that a relayState gosaml made with a key that has since been rotated out of first
+// place is signed again with the newest key - the one gosaml decodes with
+func Example_cookieKeyRingResign() {
+	conf := Conf{CookieKeys: []struct{ ID, Key string }{{"k1", "44556677"}}}
+	k1, _ := newCookieKeyRing(conf, "test", 60)
+	_, gosamlKey := k1.newest()
+	before, _ := gosamlKey.Encode("app", []byte("/app/before"))
+
+	conf.CookieKeys = append(conf.CookieKeys, struct{ ID, Key string }{"k2", "8899aabb"})
+	k2, _ := newCookieKeyRing(conf, "test", 60)
+	_, gosamlKey = k2.newest()
+	after, _ := gosamlKey.Encode("app", []byte("/app/after"))
+
+	for _, relayState := range []string{before, after} {
+		resigned := k2.resign("app", relayState)
+		app, err := gosamlKey.Decode("app", resigned)
+		fmt.Println(resigned == relayState, string(app), err)
+	}
+	other, _ := (&gosaml.Hm{TTL: 60, Hash: sha256.New, Key: []byte("other")}).Encode("app", []byte("/app/other"))
+	for _, relayState := range []string{other, "not a cookie", "k1." + before} {
+		fmt.Println(k2.resign("app", relayState) == relayState)
+	}
+
+	// a cookie signed again keeps the time it has left
+	ts := func(secondsAgo int64) []byte {
+		bs := make([]byte, 4)
+		binary.BigEndian.PutUint32(bs, uint32(time.Now().Unix()-secondsAgo))
+		return bs
+	}
+	signedAfter, _ := base64.RawURLEncoding.DecodeString(after)
+	fmt.Println(signAt(gosamlKey, "app", []byte("/app/after"), signedAfter[20:24]) == after) // as gosaml signs
+	_, k1Key := k1.newest()
+	for _, age := range []int64{50, 61} {
+		aged := signAt(k1Key, "app", []byte("/app/aged"), ts(age))
+		resigned := k2.resign("app", aged)
+		signedMsg, _ := base64.RawURLEncoding.DecodeString(resigned)
+		app, err := gosamlKey.Decode("app", resigned)
+		fmt.Println(string(app), err, bytes.Equal(signedMsg[20:24], ts(age)))
+	}
+	// Output:
+	// false /app/before <nil>
+	// true /app/after <nil>
+	// true
+	// true
+	// true
+	// true
+	// /app/aged <nil> true
+	//  ["hmac failed"] true
+}
+
+func Example_structuredLog() {
+	buf := &bytes.Buffer{}
+	logger = &structuredLogger{out: buf}
+	defer func() { logger = &structuredLogger{out: os.Stdout} }()
+	legacy := &bytes.Buffer{}
+	log.SetOutput(legacy)
+	defer log.SetOutput(os.Stderr)
+
+	h := withRoute("SsoService", appHandler(func(w http.ResponseWriter, r *http.Request) error {
+		logRecordFor(r).SP = "https://sp.example.com"
+		legacyStatLog(r, "saml20-idp-SSO", "https://sp.example.com", "https://idp.example.com", "hash")
+		return goxml.NewWerror("cause:no idp", "idp:https://idp.example.com")
+	}))
+	r := httptest.NewRequest("GET", "https://wayf.example.com/sso?x=1", nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec logRecord
+		json.Unmarshal([]byte(line), &rec)
+		fmt.Println(rec.Event, rec.Route, rec.Path, rec.Status, rec.SP, rec.ErrorClass, rec.ErrorContext, rec.Fields["tag"], rec.RequestID)
+	}
+	fmt.Println(strings.Count(legacy.String(), "\n"), strings.Contains(legacy.String(), "{"), strings.Fields(legacy.String())[3])
+	// Output:
+	// stat   0 https://sp.example.com  [] saml20-idp-SSO req-1
+	// access SsoService /sso 500 https://sp.example.com internal [cause:no idp idp:https://idp.example.com]  req-1
+	// 1 false STAT
+}
+
+func Example_marshalSamlRequest() {
+	sRequest := gosaml.SamlRequest{Nonce: "_n", RequestID: "_r", SP: "https://sp.example.com", HubBirkIndex: 1}
+	for _, msg := range [][]byte{sRequest.Marshal(), marshalSamlRequest(sRequest, "req-1")} {
+		var sr gosaml.SamlRequest
+		id := unmarshalSamlRequest(&sr, msg)
+		fmt.Printf("%q %+v\n", id, sr)
+	}
+	// Output:
+	// "" {Nonce:_n RequestID:_r SP:https://sp.example.com VirtualIDPID: AssertionConsumerIndex: Protocol: NameIDFormat:0 SPIndex:0 HubBirkIndex:1}
+	// "req-1" {Nonce:_n RequestID:_r SP:https://sp.example.com VirtualIDPID: AssertionConsumerIndex: Protocol: NameIDFormat:0 SPIndex:0 HubBirkIndex:1}
+}
+
+// Example_errorPage shows the error page for errors made with newError - the SSOService error is a gosaml error classified
+// where it is received - and for errors from outside that are only recognized by their cause or message text
+func Example_errorPage() {
+	dir := newTestConfigDir("")
+	defer os.RemoveAll(dir)
+	defer installTestConfig(dir)()
+	errs := []error{
+		fmt.Errorf("boom"),
+		goxml.Wrap(lmdq.MetaDataNotFoundError, "key:https://unknown.example.com"),
+		goxml.NewWerror("cause:unable to validate signature"),
+		fmt.Errorf("timing problem: x"),
+		checkForCommonFederations(goxml.NewXpFromString("<samlp:Response xmlns:samlp=\"urn:oasis:names:tc:SAML:2.0:protocol\"/>")),
+		SSOService(httptest.NewRecorder(), httptest.NewRequest("GET", "https://wayf.example.com/sso", nil)),
+		newError(signatureError, errors.New("boom")),
+	}
+	for _, err := range errs {
+		r := httptest.NewRequest("GET", "https://wayf.example.com/acs", nil)
+		r.Header.Set("Accept-Language", "da-DK,da;q=0.9,en;q=0.8")
+		w := httptest.NewRecorder()
+		errorPage(w, r, err, &logRecord{RequestID: "req-1"})
+		body := w.Body.String()
+		var herr hybridError
+		fmt.Println(w.Code, errorKinds[kindOf(err)].class, strings.Contains(body, "req-1"), strings.Contains(body, err.Error()), errors.As(err, &herr))
+	}
+	// Output:
+	// 500 internal true false false
+	// 400 unknown_entity true false false
+	// 403 signature true false false
+	// 400 expired true false false
+	// 403 no_common_federations true false true
+	// 400 bad_request true false true
+	// 403 signature true false true
+}
+
+func Example_samlErrorResponse() {
+	idpMd := goxml.NewXpFromString(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://wayf.wayf.dk"/>`)
+	request := goxml.NewXpFromString(`<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_req" AssertionConsumerServiceURL="https://sp.example.com/acs"/>`)
+	response := goxml.NewXpFromString(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_resp"><saml:Issuer>https://idp.example.com</saml:Issuer><samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status><saml:Assertion/></samlp:Response>`)
+	err := goxml.Wrap(checkForCommonFederations(response))
+
+	newresponse := samlErrorResponse(err, idpMd, nil, request, response, "req-1")
+	fmt.Println(newresponse.Query1(nil, "@InResponseTo"), newresponse.Query1(nil, "@Destination"), newresponse.Query1(nil, "saml:Issuer"), len(newresponse.Query(nil, "saml:Assertion")))
+	fmt.Println(newresponse.Query1(nil, "samlp:Status/samlp:StatusCode/@Value"))
+	fmt.Println(newresponse.Query1(nil, "samlp:Status/samlp:StatusCode/samlp:StatusCode/@Value"))
+	fmt.Println(newresponse.Query1(nil, "samlp:Status/samlp:StatusMessage"))
+	// Output:
+	// _req https://sp.example.com/acs https://wayf.wayf.dk 0
+	// urn:oasis:names:tc:SAML:2.0:status:Responder
+	// urn:oasis:names:tc:SAML:2.0:status:RequestDenied
+	// No common federation - reference: req-1
+}
+
+func Example_metrics() {
+	logins := (&counterVec{name: "logins", help: "Logins", labels: []string{"idp", "sp"}, values: map[string]float64{}}).limit(2)
+	logins.inc("idp1", "sp1")
+	logins.inc("idp1", "sp2")
+	logins.inc("idp2", "sp1")
+	logins.inc("idp1", "sp1")
+	logins.write(os.Stdout)
+
+	latency := &histogramVec{name: "latency", help: "Latency", labels: []string{"route"}, buckets: []float64{.1, 1}, counts: map[string][]uint64{}, sums: map[string]float64{}}
+	latency.observe(.05, "sso")
+	latency.observe(.5, "sso")
+	latency.observe(2, "sso")
+	latency.write(os.Stdout)
+	// Output:
+	// # HELP logins Logins
+	// # TYPE logins counter
+	// logins{idp="idp1",sp="sp1"} 2
+	// logins{idp="idp1",sp="sp2"} 1
+	// logins{idp="other",sp="other"} 1
+	// # HELP latency Latency
+	// # TYPE latency histogram
+	// latency_bucket{route="sso",le="0.1"} 1
+	// latency_bucket{route="sso",le="1"} 2
+	// latency_bucket{route="sso",le="+Inf"} 3
+	// latency_sum{route="sso"} 2.55
+	// latency_count{route="sso"} 3
+}
+
+func Example_clientIP() {
+	proxies, _ := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	trustedProxies.Store(proxies)
+	defer trustedProxies.Store([]*net.IPNet{})
+
+	for _, tc := range []struct{ remoteAddr, header, value string }{
+		{"198.51.100.7:1234", "X-Forwarded-For", "203.0.113.1"},                     // untrusted peer - header ignored
+		{"10.1.1.1:1234", "X-Forwarded-For", "203.0.113.9, 203.0.113.1, 192.0.2.1"}, // spoofed left entry ignored
+		{"10.1.1.1:1234", "Forwarded", `for=203.0.113.2;proto=https, for="[2001:db8::1]:4711", for=10.2.2.2`},
+		{"10.1.1.1:1234", "X-Forwarded-For", "unknown, 10.2.2.2"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		r.Header.Set(tc.header, tc.value)
+		fmt.Println(clientIP(r))
+	}
+	// Output:
+	// 198.51.100.7
+	// 203.0.113.1
+	// 2001:db8::1
+	// 10.2.2.2
+}
+
+// Example_rateLimit shows the per client IP limit and that allowlisted SPs are only exempt from the per SP limit - the
+// client IP is limited before the SP is known
+func Example_rateLimit() {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rateLimitNow = func() time.Time { return now }
+	defer func() { rateLimitNow = time.Now }()
+
+	rl := &routeLimiter{route: "MDQ", ip: newLimiter(60, 2), sp: newLimiter(60, 1), allowlist: &rateLimitAllowlist{entityIDs: map[string]bool{"https://sp.example.org": true}}}
+	rl.allowlist.nets, _ = parseCIDRs("RateLimitAllowlist", []string{"192.0.2.0/24"})
+	h := rl.wrap(appHandler(func(w http.ResponseWriter, r *http.Request) error {
+		if sp := r.Header.Get("X-SP"); sp != "" {
+			return limitSP(r, sp)
+		}
+		return nil
+	}))
+	for _, tc := range []struct {
+		remoteAddr string
+		wait       time.Duration
+		sp         string
+	}{
+		{"203.0.113.1:1234", 0, ""},
+		{"203.0.113.1:1234", 0, ""},
+		{"203.0.113.1:1234", 0, ""},
+		{"203.0.113.2:1234", 0, ""}, // other client
+		{"192.0.2.1:1234", 0, ""},   // allowlisted
+		{"203.0.113.1:1234", 1500 * time.Millisecond, ""},
+		{"203.0.113.3:1234", 0, "https://sp.example.org"}, // allowlisted SP
+		{"203.0.113.3:1234", 0, "https://sp.example.org"},
+		{"203.0.113.3:1234", 0, "https://sp.example.org"}, // still limited per client IP
+		{"203.0.113.4:1234", 0, "https://other.example.org"},
+		{"203.0.113.5:1234", 0, "https://other.example.org"},
+	} {
+		now = now.Add(tc.wait)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/MDQ/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		r.Header.Set("X-SP", tc.sp)
+		h.ServeHTTP(w, r)
+		fmt.Println(strings.TrimSpace(tc.remoteAddr+" "+tc.sp), w.Code, w.Header()["Retry-After"])
+	}
+	// Output:
+	// 203.0.113.1:1234 200 []
+	// 203.0.113.1:1234 200 []
+	// 203.0.113.1:1234 429 [1]
+	// 203.0.113.2:1234 200 []
+	// 192.0.2.1:1234 200 []
+	// 203.0.113.1:1234 200 []
+	// 203.0.113.3:1234 https://sp.example.org 200 []
+	// 203.0.113.3:1234 https://sp.example.org 200 []
+	// 203.0.113.3:1234 https://sp.example.org 429 [1]
+	// 203.0.113.4:1234 https://other.example.org 200 []
+	// 203.0.113.5:1234 https://other.example.org 429 [1]
+}
+
+// Example_rateLimitReload shows that a reload keeps the buckets of the routes with unchanged limits - waiting for a
+// reload does not give a client a full bucket - while changed limits start from scratch
+func Example_rateLimitReload() {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rateLimitNow = func() time.Time { return now }
+	defer func() { rateLimitNow = time.Now }()
+	dir := newTestConfigDir(`RateLimits = { MDQ = { IPPerMinute = 60, IPBurst = 1 } }`)
+	defer os.RemoveAll(dir)
+	defer installTestConfig(dir)()
+
+	limited := func() bool {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "https://wayf.example.org/r17/", nil)
+		r.RemoteAddr = "203.0.113.1:1234"
+		runningState().mux.ServeHTTP(w, r)
+		return w.Code == http.StatusTooManyRequests
+	}
+	fmt.Println(limited(), limited())
+	fmt.Println(reloadConfig(), limited())
+	writeTestConfig(dir, `RateLimits = { MDQ = { IPPerMinute = 120, IPBurst = 1 } }`)
+	fmt.Println(reloadConfig(), limited(), limited())
+	// Output:
+	// false true
+	// <nil> true
+	// <nil> false true
+}
+
+// Example_saml2jwtLimitSP shows that saml2jwt only charges the per SP limit for SPs found in the metadata - made up
+// issuers only count against the client IP limit and can not use up the limit of a real SP
+func Example_saml2jwtLimitSP() {
+	dir := newTestConfigDir("")
+	defer os.RemoveAll(dir)
+	defer installTestConfig(dir)()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rateLimitNow = func() time.Time { return now }
+	defer func() { rateLimitNow = time.Now }()
+
+	rl := &routeLimiter{route: "Saml2jwt", ip: newLimiter(60, 10), sp: newLimiter(60, 1), allowlist: &rateLimitAllowlist{}}
+	h := rl.wrap(appHandler(saml2jwt))
+	for _, issuer := range []string{"https://unknown.example.org", "http://wayf.ordbogen.com", "http://wayf.ordbogen.com", "https://unknown.example.org", "https://unknown.example.org", "https://auth.asiaportal.info"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/saml2jwt", nil)
+		r.Header.Set("X-Issuer", issuer)
+		h.ServeHTTP(w, r)
+		fmt.Println(issuer, w.Code, w.Header()["Retry-After"])
+	}
+	fmt.Println("sp buckets", len(rl.sp.buckets))
+	// Output:
+	// https://unknown.example.org 400 []
+	// http://wayf.ordbogen.com 302 []
+	// http://wayf.ordbogen.com 429 [1]
+	// https://unknown.example.org 400 []
+	// https://unknown.example.org 400 []
+	// https://auth.asiaportal.info 302 []
+	// sp buckets 2
+}
+
+func Example_allowOrigin() {
+	defer func(c Conf) { config = c }(config)
+	config.CORSOrigins = []string{"https://ds.example.org", "https://*.example.net"}
+	spMd := goxml.NewXpFromString(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.example.com/sp">
+<md:SPSSODescriptor><md:AssertionConsumerService Location="https://sp.example.com/acs"/></md:SPSSODescriptor></md:EntityDescriptor>`)
+
+	for _, tc := range []struct {
+		origin string
+		md     *goxml.Xp
+	}{
+		{"https://ds.example.org", nil},
+		{"https://a.example.net", nil},
+		{"https://evil.example", nil},
+		{"https://sp.example.com", nil},
+		{"https://sp.example.com", spMd},
+		{"http://ds.example.org", nil},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/MDQ/", nil)
+		r.Header.Set("Origin", tc.origin)
+		allowOrigin(w, r, tc.md)
+		fmt.Println(tc.origin, w.Header()["Access-Control-Allow-Origin"])
+	}
+	// Output:
+	// https://ds.example.org [https://ds.example.org]
+	// https://a.example.net [https://a.example.net]
+	// https://evil.example []
+	// https://sp.example.com []
+	// https://sp.example.com [https://sp.example.com]
+	// http://ds.example.org []
+}
+
+func Example_securityHeaders() {
+	for _, headers := range []map[string]string{
+		nil,
+		{"content-security-policy": "default-src 'self'; form-action 'self' https:", "Referrer-Policy": ""},
+	} {
+		h := withSecurityHeaders(Conf{SecurityHeaders: headers}, http.NotFoundHandler())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		for _, name := range []string{"Strict-Transport-Security", "X-Content-Type-Options", "Referrer-Policy", "Content-Security-Policy"} {
+			fmt.Println(name, w.Header()[name])
+		}
+	}
+	// Output:
+	// Strict-Transport-Security [max-age=31536000]
+	// X-Content-Type-Options [nosniff]
+	// Referrer-Policy [strict-origin]
+	// Content-Security-Policy []
+	// Strict-Transport-Security [max-age=31536000]
+	// X-Content-Type-Options [nosniff]
+	// Referrer-Policy []
+	// Content-Security-Policy [default-src 'self'; form-action 'self' https:]
+}
+
+func Example_serverSession() {
+	dir, _ := ioutil.TempDir("", "sessions")
+	defer os.RemoveAll(dir)
+	sqlite, _ := newSQLiteStore(dir + "/sessions.db")
+	defaultDeployment = &deployment{Domain: "wayf.dk"}
+	defer func() { defaultDeployment = nil }()
+
+	for _, s := range []serverSession{{store: newMemoryStore()}, {store: sqlite}} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		s.Set(w, r, sloCookieName, []byte("sloinfo"))
+		s.Set(w, r, "SSO2-1234", []byte("request"))
+		fmt.Println(len(w.Result().Cookies()), w.Result().Cookies()[0].Name)
+
+		r = httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(w.Result().Cookies()[0])
+		data, err := s.GetDel(w, r, "SSO2-1234")
+		fmt.Printf("%s %v\n", data, err)
+		_, err = s.Get(w, r, "SSO2-1234")
+		fmt.Println(err)
+		data, err = s.Get(w, r, sloCookieName)
+		fmt.Printf("%s %v\n", data, err)
+		_, err = s.Get(w, httptest.NewRequest("GET", "/", nil), sloCookieName)
+		fmt.Println(err)
+	}
+	// Output:
+	// 1 wayf_session
+	// request <nil>
+	// session: value not found
+	// sloinfo <nil>
+	// session: value not found
+	// 1 wayf_session
+	// request <nil>
+	// session: value not found
+	// sloinfo <nil>
+	// session: value not found
+}
+
+func Example_checkReplay() {
+	dir, _ := ioutil.TempDir("", "replays")
+	defer os.RemoveAll(dir)
+	sqlite, _ := newSQLiteReplayCache(dir + "/replays.db")
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	replayNow = func() time.Time { return now }
+	defer func() { replayNow, replays = time.Now, newMemoryReplayCache() }()
+
+	response := func(inResponseTo, assertionID string) *goxml.Xp {
+		return goxml.NewXpFromString(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" InResponseTo="` + inResponseTo + `">
+<saml:Issuer>https://idp.example.org</saml:Issuer><saml:Assertion ID="` + assertionID + `"><saml:Conditions NotOnOrAfter="2020-01-01T12:10:00Z"/></saml:Assertion></samlp:Response>`)
+	}
+	r := httptest.NewRequest("POST", "/acs", nil)
+	for _, cache := range []replayCache{newMemoryReplayCache(), sqlite} {
+		replays = cache
+		now = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		fmt.Println(checkReplay(r, response("_r1", "_a1")))
+		fmt.Println(checkReplay(r, response("_r1", "_a1")))
+		fmt.Println(checkReplay(r, response("_r2", "_a1")))
+		now = now.Add(11 * time.Minute)
+		fmt.Println(checkReplay(r, response("_r1", "_a1")))
+	}
+	// Output:
+	// <nil>
+	// replay: InResponseTo _r1 from https://idp.example.org is already used
+	// replay: Assertion ID _a1 from https://idp.example.org is already used
+	// <nil>
+	// <nil>
+	// replay: InResponseTo _r1 from https://idp.example.org is already used
+	// replay: Assertion ID _a1 from https://idp.example.org is already used
+	// <nil>
+}
+
+func Example_saveSLOInfo() {
+	defaultDeployment = &deployment{Domain: "wayf.dk"}
+	sloInfoCookie, _ = newCookieKeyRing(Conf{SecureCookieHashKey: "00112233445566778899aabbccddeeff"}, "sloinfo", sloInfoTTL)
+	defer func() { defaultDeployment, sloInfoCookie, sloFallback = nil, nil, nil }()
+
+	sessions := func(n int) *gosaml.SLOInfoList {
+		sil := gosaml.SLOInfoList{}
+		for i := 0; i < n; i++ {
+			random := []byte{} // does not compress - gosaml's Marshal only allows 255 bytes per field
+			for h := 0; h < 16; h++ {
+				sum := sha1.Sum([]byte(fmt.Sprint(i, h)))
+				random = append(random, sum[:]...)
+			}
+			sil = append(sil, gosaml.SLOInfo{IDP: "https://wayf.wayf.dk", SP: fmt.Sprintf("https://sp%d.example.org", i), NameID: base64.StdEncoding.EncodeToString(random[:160]), SessionIndex: base64.StdEncoding.EncodeToString(random[160:]), SLOSupport: true})
+		}
+		return &sil
+	}
+	roundtrip := func(w *httptest.ResponseRecorder) (names []string, n int) {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range w.Result().Cookies() {
+			if c.Value != "" { // not deleted
+				r.AddCookie(c)
+				names = append(names, c.Name)
+			}
+		}
+		return names, len(*loadSLOInfo(httptest.NewRecorder(), r))
+	}
+
+	for _, fallback := range []HybridSession{nil, serverSession{store: newMemoryStore()}} {
+		sloFallback = fallback
+		for _, n := range []int{5, 10, 30} {
+			w := httptest.NewRecorder()
+			err := saveSLOInfo(w, httptest.NewRequest("GET", "/", nil), sessions(n))
+			names, loaded := roundtrip(w)
+			fmt.Println(n, err, names, loaded)
+		}
+	}
 	// Output:
-	//
+	// 5 <nil> [SLO] 5
+	// 10 <nil> [SLO SLO-2] 10
+	// 30 <nil> [SLO SLO-2] 16
+	// 5 <nil> [SLO] 5
+	// 10 <nil> [SLO SLO-2] 10
+	// 30 <nil> [wayf_session] 30
 }
 
-func ExampleDebify() {
-	fmt.Println(debify.ReplaceAllString("https://birk.wayf.dk/birk.php/example.com/test", "$1$2"))
-	fmt.Println(debify.ReplaceAllString("https://example.com/test", "$1$2"))
-	fmt.Println(debify.ReplaceAllString("urn:oid:1.3.6.1.4.1.39153:42:idp.entity.test", "$1$2"))
-	fmt.Println(debify.ReplaceAllString("idp.entity.test", "$1$2"))
+func Example_hubSSO() {
+	defaultDeployment = &deployment{Domain: "wayf.dk"}
+	sloInfoCookie, _ = newCookieKeyRing(Conf{SecureCookieHashKey: "00112233445566778899aabbccddeeff"}, "sloinfo", sloInfoTTL)
+	config.HubSSOTTL = time.Hour
+	authnInstant := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	hubSSONow = func() time.Time { return authnInstant.Add(10 * time.Minute) }
+	defer func() {
+		defaultDeployment, sloInfoCookie, config.HubSSOTTL, hubSSONow = nil, nil, 0, time.Now
+	}()
+
+	response := goxml.NewXpFromString(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_r1" Version="2.0">
+<saml:Issuer>https://idp.example.org</saml:Issuer>
+<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+<saml:Assertion ID="_a1" Version="2.0"><saml:Issuer>https://idp.example.org</saml:Issuer>
+<saml:Subject><saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:transient">_nameid</saml:NameID></saml:Subject>
+<saml:AuthnStatement AuthnInstant="` + authnInstant.Format(gosaml.XsDateTime) + `" SessionIndex="_session"><saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:Password</saml:AuthnContextClassRef></saml:AuthnContext></saml:AuthnStatement>
+<saml:AttributeStatement><saml:Attribute Name="eduPersonPrincipalName"><saml:AttributeValue>joe@example.org</saml:AttributeValue></saml:Attribute>
+<saml:Attribute Name="eduPersonAffiliation"><saml:AttributeValue>member</saml:AttributeValue><saml:AttributeValue>staff</saml:AttributeValue></saml:Attribute></saml:AttributeStatement>
+</saml:Assertion></samlp:Response>`)
+
+	w := httptest.NewRecorder()
+	saveHubSSO(w, httptest.NewRequest("GET", "/", nil), response, "https://wayf.wayf.dk")
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+		fmt.Println(c.Name, !strings.Contains(c.Value, "joe@example.org"))
+	}
+
+	spMd := goxml.NewXpFromString(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.example.org"/>`)
+	optOutMd := goxml.NewXpFromString(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:wayf="http://wayf.dk/2014/08/wayf" entityID="https://sp.example.org"><md:Extensions><wayf:wayf><wayf:noHubSSO>true</wayf:noHubSSO></wayf:wayf></md:Extensions></md:EntityDescriptor>`)
+	authnRequest := func(attrs, inner string) *goxml.Xp {
+		return goxml.NewXpFromString(`<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_req" ` + attrs + `>` + inner + `</samlp:AuthnRequest>`)
+	}
+	password := `<saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:Password</saml:AuthnContextClassRef>`
+	for _, tc := range []struct {
+		request        *goxml.Xp
+		md             *goxml.Xp
+		idp, hubKribSP string
+	}{
+		{authnRequest("", ""), spMd, "https://idp.example.org", "https://wayf.wayf.dk"},
+		{authnRequest(`IsPassive="true"`, ""), spMd, "https://idp.example.org", "https://wayf.wayf.dk"},
+		{authnRequest(`IsPassive="false"`, ""), spMd, "https://idp.example.org", "https://wayf.wayf.dk"},
+		{authnRequest("", ""), spMd, "https://other.example.org", "https://wayf.wayf.dk"},
+		{authnRequest(`IsPassive="true"`, ""), spMd, "https://other.example.org", "https://wayf.wayf.dk"}, // the IdP is asked passively
+		{authnRequest("", ""), spMd, "https://idp.example.org", "https://krib.example.org"},
+		{authnRequest(`ForceAuthn="true"`, ""), spMd, "https://idp.example.org", "https://wayf.wayf.dk"},
+		{authnRequest(`ForceAuthn="1"`, ""), spMd, "https://idp.example.org", "https://wayf.wayf.dk"},
+		{authnRequest("", ""), optOutMd, "https://idp.example.org", "https://wayf.wayf.dk"},
+		{authnRequest("", `<samlp:RequestedAuthnContext>`+password+`</samlp:RequestedAuthnContext>`), spMd, "https://idp.example.org", "https://wayf.wayf.dk"},
+		{authnRequest("", `<samlp:RequestedAuthnContext Comparison="minimum">`+password+`</samlp:RequestedAuthnContext>`), spMd, "https://idp.example.org", "https://wayf.wayf.dk"},
+		{authnRequest("", `<samlp:RequestedAuthnContext><saml:AuthnContextClassRef>https://refeds.org/profile/mfa</saml:AuthnContextClassRef></samlp:RequestedAuthnContext>`), spMd, "https://idp.example.org", "https://wayf.wayf.dk"},
+	} {
+		_, result := reusableHubSSO(httptest.NewRecorder(), r, tc.request, tc.md, tc.idp, tc.hubKribSP)
+		fmt.Println(result)
+	}
+
+	hubSSONow = func() time.Time { return authnInstant.Add(2 * time.Hour) }
+	e, result := reusableHubSSO(httptest.NewRecorder(), r, authnRequest("", ""), spMd, "https://idp.example.org", "https://wayf.wayf.dk")
+	fmt.Println(result)
+	_, result = reusableHubSSO(httptest.NewRecorder(), r, authnRequest(`IsPassive="true"`, ""), spMd, "https://idp.example.org", "https://wayf.wayf.dk")
+	fmt.Println(result)
+
+	made := e.response(authnRequest("", ""))
+	for _, xpath := range []string{"@InResponseTo", "saml:Issuer", "saml:Assertion/saml:Subject/saml:NameID", "saml:Assertion/saml:AuthnStatement/@SessionIndex", "saml:Assertion/saml:AuthnStatement/saml:AuthnContext/saml:AuthnContextClassRef"} {
+		fmt.Println(made.Query1(nil, xpath))
+	}
+	fmt.Println(made.QueryMulti(nil, "saml:Assertion/saml:AttributeStatement/saml:Attribute[@Name='eduPersonAffiliation']/saml:AttributeValue"))
+
+	// Output:
+	// HUBSSO true
+	// reused
+	// reused
+	// reused
+	// miss
+	// miss
+	// miss
+	// forceauthn
+	// forceauthn
+	// optout
+	// reused
+	// authncontext
+	// authncontext
+	// expired
+	// expired
+	// _req
+	// https://idp.example.org
+	// _nameid
+	// _session
+	// urn:oasis:names:tc:SAML:2.0:ac:classes:Password
+	// [member staff]
+}
+
+func Example_refreshMetadataFeed() {
+	md, _ := ioutil.ReadFile("testdata/test-metadata.mddb")
+	one, _ := ioutil.ReadFile("testdata/one.mddb")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	sign := func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		return sig
+	}
+	digest := sha256.Sum256(md)
+	manifest := []byte(hex.EncodeToString(digest[:]) + "  md.mddb\n")
+	files := map[string][]byte{
+		"/md.mddb": md, "/md.mddb.sig": sign(md), "/html.mddb": []byte("<html>Not here</html>"), "/one.mddb": one,
+		"/unsigned.mddb": md, "/unsigned.mddb.sig": sign(one), "/SHA256SUMS": manifest, "/SHA256SUMS.sig": []byte(base64.StdEncoding.EncodeToString(sign(manifest))),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if data, ok := files[r.URL.Path]; ok {
+			w.Write(data)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	dir, _ := ioutil.TempDir("", "feed")
+	defer os.RemoveAll(dir)
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	ioutil.WriteFile(dir+"/key.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0600)
+	defer func() { config = Conf{} }()
+
+	mddb := dir + "/feed.mddb"
+	refresh := func(name string) {
+		feed, err := refreshMetadataFeed(config, mddb, srv.URL+name)
+		if err == nil {
+			err = swapMetadata(config, []feedReport{feed})
+		}
+		msg := fmt.Sprint(err)
+		msg = strings.Replace(strings.Replace(msg, srv.URL, "", -1), dir, "", -1)
+		fmt.Println(name, feed.Entities, msg)
+	}
+	config.MetadataMaxSize = 1000
+	refresh("/md.mddb")
+	config.MetadataMaxSize = 0
+	refresh("/missing.mddb")
+	refresh("/html.mddb")
+	refresh("/md.mddb")
+	config.MetadataMaxEntityDrop = 50
+	refresh("/one.mddb")
+	config.MetadataSigningKey = dir + "/key.pem"
+	refresh("/unsigned.mddb")
+	refresh("/md.mddb")
+	config.MetadataManifestURL = srv.URL + "/SHA256SUMS"
+	refresh("/md.mddb")
+	refresh("/unsigned.mddb")
+	// Output:
+	// /md.mddb 0 metadata feed /feed.mddb: /md.mddb: more than the max 1000 bytes
+	// /missing.mddb 0 metadata feed /feed.mddb: /missing.mddb: status 404 Not Found
+	// /html.mddb 0 metadata feed /feed.mddb: not a sqlite database
+	// /md.mddb 81 <nil>
+	// /one.mddb 1 metadata feed /feed.mddb: entities dropped 98% from 81 to 1 - the max is 50%
+	// /unsigned.mddb 0 metadata feed /feed.mddb: /unsigned.mddb: crypto/rsa: verification error
+	// /md.mddb 81 <nil>
+	// /md.mddb 81 <nil>
+	// /unsigned.mddb 0 metadata feed /feed.mddb: manifest: unsigned.mddb not found
+}
+
+func Example_runDueFeeds() {
+	md, _ := ioutil.ReadFile("testdata/test-metadata.mddb")
+	failing, downloads := false, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case failing:
+			http.Error(w, "down", http.StatusInternalServerError)
+		case r.Header.Get("If-None-Match") == `"v1"`:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			downloads++
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(md)
+		}
+	}))
+	defer srv.Close()
+	dir, _ := ioutil.TempDir("", "feed")
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	metadataUpdateGuard = make(chan int, 1)
+	config.MetadataFeeds = []struct{ Path, URL string }{{dir + "/feed.mddb", srv.URL + "/md.mddb"}}
+	config.MetadataRefresh = time.Hour
+	feedNow, feedJitter = func() time.Time { return now }, func(d time.Duration) time.Duration { return d }
+	defer func() {
+		config, feedStates, feedNow, metadataUpdateGuard = Conf{}, map[string]*feedState{}, time.Now, nil
+		feedJitter = func(d time.Duration) time.Duration { return d }
+	}()
+
+	run := func(after time.Duration) {
+		now = now.Add(after)
+		wait := runDueFeeds(now)
+		s := feedStatusFor(dir + "/feed.mddb")
+		fmt.Println(wait, s.NextRun, downloads, s.Failures, s.LastSuccess, s.LastError != "")
+	}
+	run(0)
+	run(time.Hour)
+	run(time.Hour)
+	failing = true
+	run(time.Hour)
+	run(30 * time.Second)
+	run(time.Minute)
+	failing = false
+	run(2 * time.Minute)
+	// Output:
+	// 1m0s 2026-10-01T13:00:00Z 0 0  false
+	// 1m0s 2026-10-01T14:00:00Z 1 0 2026-10-01T13:00:00Z false
+	// 1m0s 2026-10-01T15:00:00Z 1 0 2026-10-01T14:00:00Z false
+	// 30s 2026-10-01T15:00:30Z 1 1 2026-10-01T14:00:00Z true
+	// 1m0s 2026-10-01T15:01:30Z 1 2 2026-10-01T14:00:00Z true
+	// 1m0s 2026-10-01T15:03:30Z 1 3 2026-10-01T14:00:00Z true
+	// 1m0s 2026-10-01T16:03:30Z 1 0 2026-10-01T15:03:30Z true
+}
+
+// Example_refreshFeedsFailure shows that a feed that fails is scheduled for a retry on its own and does not stop the other feeds
+func Example_refreshFeedsFailure() {
+	md, _ := ioutil.ReadFile("testdata/test-metadata.mddb")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad.mddb" {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Write(md)
+	}))
+	defer srv.Close()
+	dir, _ := ioutil.TempDir("", "feed")
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	metadataUpdateGuard = make(chan int, 1)
+	config.MetadataFeeds = []struct{ Path, URL string }{{dir + "/bad.mddb", srv.URL + "/bad.mddb"}, {dir + "/good.mddb", srv.URL + "/good.mddb"}}
+	config.MetadataRefresh = time.Hour
+	feedNow, feedJitter = func() time.Time { return now }, func(d time.Duration) time.Duration { return d }
+	defer func() {
+		config, feedStates, feedNow, metadataUpdateGuard = Conf{}, map[string]*feedState{}, time.Now, nil
+		feedJitter = func(d time.Duration) time.Duration { return d }
+	}()
+
+	report, err := refreshFeeds()
+	fmt.Println(report.Status, len(report.Feeds), err != nil && strings.Contains(err.Error(), dir+"/bad.mddb"))
+	for _, feed := range []string{"bad", "good"} {
+		s := feedStatusFor(dir + "/" + feed + ".mddb")
+		_, statErr := os.Stat(dir + "/" + feed + ".mddb")
+		fmt.Println(feed, s.Failures, s.NextRun, s.LastSuccess, statErr == nil)
+	}
+	// Output:
+	// refreshed 1 true
+	// bad 1 2026-10-01T12:00:30Z  false
+	// good 0 2026-10-01T13:00:00Z 2026-10-01T12:00:00Z true
+}
+
+// lookupFailures counts the lookups in mdq that fail for other reasons than a missing entity - the lookups are done at
+// the same time so the pool of the set opens new connections
+func lookupFailures(mdq *lmdq.MDQ) (failed int) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	start := make(chan bool)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 10; j++ {
+				if _, err := mdq.MDQ(fmt.Sprintf("https://missing%d-%d.example.org", i, j)); err != nil && !strings.Contains(err.Error(), "Metadata not found") {
+					lock.Lock()
+					failed++
+					lock.Unlock()
+				}
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return
+}
+
+func Example_swapMetadata() {
+	dir, _ := ioutil.TempDir("", "swap")
+	defer os.RemoveAll(dir)
+	md, _ := ioutil.ReadFile("testdata/test-metadata.mddb")
+	one, _ := ioutil.ReadFile("testdata/one.mddb")
+	os.MkdirAll(dir+"/hybrid-config/templates", 0700)
+	ioutil.WriteFile(dir+"/hybrid-config/templates/hybrid.tmpl", []byte(`{{define "postForm"}}{{end}}`), 0600)
+	mddb := dir + "/md.mddb"
+	ioutil.WriteFile(mddb, md, 0600)
+	temp := func(data []byte) string {
+		f, _ := ioutil.TempFile(dir, "")
+		f.Write(data)
+		f.Close()
+		return f.Name()
+	}
+
+	configPath = dir + "/"
+	config = Conf{HubEntityID: "https://wayf.wayf.dk"}
+	for _, set := range []struct {
+		c     *mdConf
+		table string
+	}{{&config.Hub, "HYBRID_HUB"}, {&config.Internal, "HYBRID_INTERNAL"}, {&config.ExternalIDP, "HYBRID_EXTERNAL_IDP"}, {&config.ExternalSP, "HYBRID_EXTERNAL_SP"}} {
+		*set.c = mdConf{Path: "file:" + mddb + "?mode=ro", Table: set.table}
+	}
+	defaultDeployment, deployments, _ = newDeployments(config, nil)
+	defer func() { config, configPath, defaultDeployment, deployments = Conf{}, "", nil, nil }()
+
+	hub, tmpl := defaultDeployment.md.Hub, defaultDeployment.tmpl
+	os.Remove(dir + "/hybrid-config/templates/hybrid.tmpl") // the swap copies the running deployments - nothing is read from the config
+	err := swapMetadata(config, []feedReport{{Path: mddb, temp: temp(md)}})
+	fmt.Println(err, defaultDeployment.md.Hub != hub, defaultDeployment.md.Hub.Path == config.Hub.Path, lookupFailures(defaultDeployment.md.Hub))
+	_, err = hub.MDQ("https://missing.example.org")
+	fmt.Println(defaultDeployment.tmpl == tmpl, strings.Contains(fmt.Sprint(err), "Metadata not found")) // the replaced set is retired - closed only when the requests in flight are done
+	closeMdqs([]*lmdq.MDQ{hub})
+	_, err = hub.MDQ("https://missing.example.org/2")
+	fmt.Println(err)
+
+	hub = defaultDeployment.md.Hub
+	os.Remove(mddb + ".prev")
+	bad := temp(one)
+	err = swapMetadata(config, []feedReport{{Path: mddb, temp: bad}})
+	fmt.Println(strings.Replace(strings.Replace(fmt.Sprint(err), bad, "<temp>", -1), dir, "", -1), defaultDeployment.md.Hub == hub)
+	current, _ := ioutil.ReadFile(mddb)
+	_, err = defaultDeployment.md.Hub.MDQ("https://wayf.wayf.dk")
+	_, prevErr := os.Stat(mddb + ".prev")
+	fmt.Println(bytes.Equal(current, md), err, os.IsNotExist(prevErr)) // the live mddb was never touched
+
+	defaultDeployment, deployments = nil, nil // at startup there are no deployments yet - the checks are the same
+	err = swapMetadata(config, []feedReport{{Path: mddb, temp: temp(one)}})
+	current, _ = ioutil.ReadFile(mddb)
+	fmt.Println(err != nil, bytes.Equal(current, md))
+	err = swapMetadata(config, []feedReport{{Path: mddb, temp: temp(md)}})
+	fmt.Println(err, defaultDeployment == nil)
+	// Output:
+	// <nil> true true 0
+	// true true
+	// sql: statement is closed
+	// metadata: metadata hub: no such table: entity_HYBRID_HUB - keeping the current metadata true
+	// true <nil> true
+	// true true
+	// <nil> true
+}
+
+func Example_pinGeneration() {
+	md, _ := ioutil.ReadFile("testdata/test-metadata.mddb")
+	one, _ := ioutil.ReadFile("testdata/one.mddb")
+	serving := md
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(serving) }))
+	defer srv.Close()
+	dir, _ := ioutil.TempDir("", "generations")
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	metadataUpdateGuard = make(chan int, 1)
+	config.MetadataFeeds = []struct{ Path, URL string }{{dir + "/feed.mddb", srv.URL + "/md.mddb"}}
+	config.MetadataGenerations = 2
+	feedNow = func() time.Time { return now }
+	defer func() {
+		config, feedStates, feedNow, metadataUpdateGuard = Conf{}, map[string]*feedState{}, time.Now, nil
+	}()
+
+	short := map[string]string{}
+	for name, data := range map[string][]byte{"md": md, "one": one} {
+		sum := sha256.Sum256(data)
+		short[hex.EncodeToString(sum[:])] = name
+	}
+	list := func(status string) {
+		gens, _ := listGenerations(dir + "/feed.mddb")
+		fmt.Print(status, " pinned:", gens.Pinned != "")
+		for _, gen := range gens.Generations {
+			fmt.Print(" ", gen.Time.Format("15:04"), "/", short[gen.SHA256], "/", gen.Live)
+		}
+		fmt.Println()
+	}
+	refresh := func(data []byte) {
+		now, serving = now.Add(time.Hour), data
+		report, err := refreshFeeds()
+		list(fmt.Sprint(report.Status, err))
+	}
+	refresh(md)
+	refresh(one)
+	refresh(md)
+	gens, _ := listGenerations(dir + "/feed.mddb")
+	fmt.Println(pinGeneration(dir+"/feed.mddb", gens.Generations[1].Name))
+	list("pinned")
+	refresh(md)
+	s := feedStatusFor(dir + "/feed.mddb") // a pinned feed is not refreshed - the last success is from before the pin
+	fmt.Println(s.LastSuccess, s.Pinned == gens.Generations[1].Name, feedPins.collect()[dir+"/feed.mddb"])
+	fmt.Println(pinGeneration(dir+"/feed.mddb", "20261001T120000Z-0000000000000000000000000000000000000000000000000000000000000000.mddb") != nil)
+	fmt.Println(releasePin(dir+"/feed.mddb"))
+	refresh(md)
+	// Output:
+	// refreshed<nil> pinned:false 13:00/md/true
+	// refreshed<nil> pinned:false 14:00/one/true 13:00/md/false
+	// refreshed<nil> pinned:false 15:00/md/true 14:00/one/false
+	// <nil>
+	// pinned pinned:true 15:00/md/false 14:00/one/true
+	// unchanged<nil> pinned:true 15:00/md/false 14:00/one/true
+	// 2026-10-01T15:00:00Z true 1
+	// true
+	// <nil>
+	// refreshed<nil> pinned:false 17:00/md/true 14:00/one/false
+}
+
+// Example_pinGenerationLookups shows that the metadata sets of a pinned generation read the installed mddb - not the link
+// to the generation that was swapped in and removed
+func Example_pinGenerationLookups() {
+	dir := newTestConfigDir("")
+	defer os.RemoveAll(dir)
+	defer installTestConfig(dir)()
+	feed := dir + "/md.mddb"
+	md, _ := ioutil.ReadFile(feed)
+	ioutil.WriteFile(dir+"/v2.mddb", md, 0600)
+	db, _ := sql.Open("sqlite3", dir+"/v2.mddb")
+	db.Exec("PRAGMA user_version = 2") // a new mddb with the same metadata
+	db.Close()
+	v2, _ := ioutil.ReadFile(dir + "/v2.mddb")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(v2) }))
+	defer srv.Close()
+
+	installed := time.Date(2026, 10, 1, 11, 0, 0, 0, time.UTC)
+	os.Chtimes(feed, installed, installed)
+	config.MetadataFeeds = []struct{ Path, URL string }{{feed, srv.URL + "/md.mddb"}}
+	feedNow = func() time.Time { return installed.Add(time.Hour) }
+	defer func() { feedStates, feedNow = map[string]*feedState{}, time.Now }()
+
+	addLiveGenerations(config)
+	report, err := refreshFeeds()
+	fmt.Println(report.Status, err, lookupFailures(defaultDeployment.md.Hub))
+	gens, _ := listGenerations(feed)
+	fmt.Println(pinGeneration(feed, gens.Generations[1].Name))
+	current, _ := ioutil.ReadFile(feed)
+	_, err = os.Stat(feed + ".pin")
+	fmt.Println(bytes.Equal(current, md), os.IsNotExist(err), lookupFailures(defaultDeployment.md.Hub))
+	// Output:
+	// refreshed <nil> 0
+	// <nil>
+	// true true 0
+}
+
+// Example_addLiveGenerations shows that the mddb a feed has at startup is saved as a generation so it can be pinned
+// again after a refresh has replaced it
+func Example_addLiveGenerations() {
+	md, _ := ioutil.ReadFile("testdata/test-metadata.mddb")
+	one, _ := ioutil.ReadFile("testdata/one.mddb")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(md) }))
+	defer srv.Close()
+	dir, _ := ioutil.TempDir("", "generations")
+	defer os.RemoveAll(dir)
+
+	feed := dir + "/feed.mddb"
+	installed := time.Date(2026, 10, 1, 11, 0, 0, 0, time.UTC)
+	ioutil.WriteFile(feed, one, 0644)
+	os.Chtimes(feed, installed, installed)
+	metadataUpdateGuard = make(chan int, 1)
+	config.MetadataFeeds = []struct{ Path, URL string }{{feed, srv.URL + "/md.mddb"}, {dir + "/missing.mddb", srv.URL + "/md.mddb"}}
+	feedNow = func() time.Time { return installed.Add(2 * time.Hour) }
+	defer func() {
+		config, feedStates, feedNow, metadataUpdateGuard = Conf{}, map[string]*feedState{}, time.Now, nil
+	}()
+
+	list := func() {
+		gens, _ := listGenerations(feed)
+		for _, gen := range gens.Generations {
+			fmt.Print(gen.Time.Format("15:04"), "/", gen.Size == int64(len(md)), "/", gen.Live, " ")
+		}
+		fmt.Println(gens.Pinned != "")
+	}
+	addLiveGenerations(config)
+	list()
+	addLiveGenerations(config) // the live mddb is already a generation
+	list()
+	refreshFeeds(config.MetadataFeeds[0].Path)
+	list()
+	gens, _ := listGenerations(feed)
+	fmt.Println(pinGeneration(feed, gens.Generations[1].Name))
+	list()
+	current, _ := ioutil.ReadFile(feed)
+	fmt.Println(bytes.Equal(current, one))
+	// Output:
+	// 11:00/false/true false
+	// 11:00/false/true false
+	// 13:00/true/true 11:00/false/false false
+	// <nil>
+	// 13:00/true/false 11:00/false/true true
+	// true
+}
+
+// writeTestCert writes a self-signed certificate for cn and its key as PEM
+func writeTestCert(certFile, keyFile, cn string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: cn}, DNSNames: []string{cn},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// newTestConfigDir makes a WAYF_PATH with a complete config that uses the test metadata - extra is added at the top of the toml.
+// The caller removes it.
+func newTestConfigDir(extra string) (dir string) {
+	dir, _ = ioutil.TempDir("", "hybrid")
+	os.MkdirAll(dir+"/hybrid-config/templates", 0700)
+	ioutil.WriteFile(dir+"/hybrid-config/templates/hybrid.tmpl", []byte(`{{define "postForm"}}{{end}}{{define "attributeReleaseForm"}}{{end}}`), 0600)
+	writeTestCert(dir+"/cert.pem", dir+"/key.pem", "wayf.example.org")
+	md, _ := ioutil.ReadFile("testdata/test-metadata.mddb")
+	ioutil.WriteFile(dir+"/md.mddb", md, 0600)
+	writeTestConfig(dir, extra)
+	return
+}
+
+// writeTestConfig writes the config in dir made by newTestConfigDir with extra at the top
+func writeTestConfig(dir, extra string) {
+	toml := extra + `
+HubEntityID = "https://wayf.wayf.dk"
+SecureCookieHashKey = "00112233445566778899aabbccddeeff"
+AdminToken = "sekret"
+HTTPSCert = "` + dir + `/cert.pem"
+HTTPSKey = "` + dir + `/key.pem"
+`
+	for i, route := range []string{"SsoService", "Acs", "Vvpmss", "Oauth", "Idpslo", "Birkslo", "Spslo", "Kribslo", "Nemloginslo", "NemloginAcs", "Birk", "Krib",
+		"Dsbackend", "Dstiming", "Public", "Saml2jwt", "Jwt2saml", "MDQ", "TestSPAcs", "TestSPSlo", "TestSP2Acs", "TestSP2Slo"} {
+		toml += fmt.Sprintf("%s = \"/r%d/\"\n", route, i)
+	}
+	toml += "TestSP = \"testsp.example.org\"\nTestSP2 = \"testsp2.example.org\"\n"
+	for set, table := range map[string]string{"Hub": "HYBRID_HUB", "Internal": "HYBRID_INTERNAL", "ExternalIDP": "HYBRID_EXTERNAL_IDP", "ExternalSP": "HYBRID_EXTERNAL_SP"} {
+		toml += fmt.Sprintf("[%s]\nPath = \"file:%s/md.mddb?mode=ro\"\nTable = %q\n", set, dir, table)
+	}
+	ioutil.WriteFile(dir+"/hybrid-config/hybrid-config.toml", []byte(toml), 0600)
+}
+
+// installTestConfig loads and installs the config in dir - the returned func puts the empty state back
+func installTestConfig(dir string) (cleanup func()) {
+	configPath = dir + "/"
+	metadataUpdateGuard = make(chan int, 1)
+	conf, err := loadConfig(configPath + "hybrid-config/hybrid-config.toml")
+	if err != nil {
+		panic(err)
+	}
+	st, err := newHybridState(conf, nil)
+	if err != nil {
+		panic(err)
+	}
+	st.install()
+	return func() {
+		stateLock.Lock()
+		config, configPath, deployments, defaultDeployment, hybridMux, rateLimiters, metadataUpdateGuard = Conf{}, "", nil, nil, nil, nil, nil
+		sloInfoCookie, authnRequestCookie = nil, nil
+		stateLock.Unlock()
+	}
+}
+
+// Example_reloadConfig shows that a HUP and the /reload admin endpoint swap in a changed config, that a broken one is not
+// used and that a request in flight neither holds up the reload nor sees it
+func Example_reloadConfig() {
+	dir := newTestConfigDir(`CORSOrigins = ["https://one.example.org"]`)
+	defer os.RemoveAll(dir)
+	defer installTestConfig(dir)()
+	cors := func() []string { return runningState().config.CORSOrigins }
+
+	signals, listenerErrors, done := make(chan os.Signal, 1), make(chan error), make(chan error)
+	go func() { done <- waitForSignals(signals, listenerErrors) }()
+	writeTestConfig(dir, `CORSOrigins = ["https://two.example.org"]`)
+	signals <- syscall.SIGHUP
+	for i := 0; i < 100 && cors()[0] != "https://two.example.org"; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	fmt.Println("HUP", cors())
+
+	reload := func() {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/reload", nil)
+		r.Header.Set("Authorization", "Bearer sekret")
+		adminHandler(reloadService).ServeHTTP(w, r)
+		fmt.Println(w.Code, cors())
+	}
+	writeTestConfig(dir, `CORSOrigins = ["https://three.example.org"]`)
+	reload()
+	writeTestConfig(dir, `CORSOrigins = ["https://four.example.org"]`+"\nSessionStore = \"nosuchstore\"")
+	reload()
+
+	started, release := make(chan bool), make(chan bool)
+	stateLock.Lock()
+	hybridMux = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		fmt.Println("in flight", stateFor(r).config.CORSOrigins)
+	})
+	stateLock.Unlock()
+	served := make(chan bool)
+	go func() {
+		(&slashFix{}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		served <- true
+	}()
+	<-started
+	writeTestConfig(dir, `CORSOrigins = ["https://five.example.org"]`)
+	fmt.Println("reload", reloadConfig(), cors())
+	release <- true
+	<-served
+
+	signals <- syscall.SIGTERM
+	fmt.Println("TERM", <-done)
+	// Output:
+	// HUP [https://two.example.org]
+	// 200 [https://three.example.org]
+	// 500 [https://three.example.org]
+	// reload <nil> [https://five.example.org]
+	// in flight [https://three.example.org]
+	// TERM <nil>
+}
+
+// Example_checkConfigCmd shows the -checkconfig output for a good config, a broken one and one that does not parse
+func Example_checkConfigCmd() {
+	dir := newTestConfigDir("")
+	defer os.RemoveAll(dir)
+	configPath = dir + "/"
+	defer func() { configPath = "" }()
+	check := func() {
+		conf, err := loadConfig(configPath + "hybrid-config/hybrid-config.toml")
+		fmt.Println("exit", checkConfigCmd(conf, err))
+	}
+	check()
+	writeTestConfig(dir, `SessionStore = "nosuchstore"`+"\nTrustedProxies = [\"10.0.0.0/33\"]")
+	check()
+	ioutil.WriteFile(dir+"/hybrid-config/hybrid-config.toml", []byte("HubEntityID = "), 0600)
+	check()
+	// Output:
+	// config OK
+	// exit 0
+	// TrustedProxies: invalid CIDR address: 10.0.0.0/33
+	// SessionStore: unknown store "nosuchstore"
+	// 2 problem(s) found
+	// exit 1
+	// config file: (1, 15): expecting a value
+	// exit 1
+}
+
+// Example_shutdown shows that a graceful shutdown stops taking new logins, lets the requests in flight finish and
+// gives up on them when the grace period is over
+func Example_shutdown() {
+	defer setReady(true)
+	serve := func(release chan bool) (srv *http.Server, url string, started chan bool) {
+		started = make(chan bool)
+		srv = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+			<-release
+			w.Write([]byte("done"))
+		})}
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		go srv.Serve(l)
+		srv.Addr, url = l.Addr().String(), "http://"+l.Addr().String()+"/"
+		return
+	}
+	get := func(url string, res chan string) {
+		resp, err := http.Get(url)
+		if err != nil {
+			res <- "refused"
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		res <- string(body)
+	}
+
+	release := make(chan bool)
+	srv, url, started := serve(release)
+	res := make(chan string)
+	go get(url, res)
+	<-started
+	done := make(chan error)
+	go func() { done <- shutdown(0, time.Second, srv) }()
+	for i := 0; i < 100 && isReady(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Println("ready", isReady())
+	release <- true
+	fmt.Println("in flight", <-res)
+	fmt.Println("shutdown", <-done)
+	go get(url, res)
+	fmt.Println("after", <-res)
+
+	setReady(true)
+	stuck := make(chan bool)
+	defer close(stuck)
+	srv, url, started = serve(stuck)
+	go get(url, make(chan string, 1))
+	<-started
+	fmt.Println("shutdown", shutdown(0, 50*time.Millisecond, srv) != nil)
+	// Output:
+	// ready false
+	// in flight done
+	// shutdown <nil>
+	// after refused
+	// shutdown true
+}
+
+// Example_certReloader shows that the front listener picks up a renewed certificate without a restart and keeps
+// the one it has if the new files are broken
+func Example_certReloader() {
+	dir, _ := ioutil.TempDir("", "certs")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	writeTestCert(certFile, keyFile, "one.example.org")
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	l, _ := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: cr.GetCertificate})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	served := func() {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Println(conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	}
+	renewed := func() { // pretend the files are newer and the check interval has passed
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(certFile, later, later)
+		cr.lock.Lock()
+		cr.checked = time.Time{}
+		cr.lock.Unlock()
+	}
+	served()
+	writeTestCert(certFile, keyFile, "two.example.org")
+	served()
+	renewed()
+	served()
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	renewed()
+	served()
+	// Output:
+	// one.example.org
+	// one.example.org
+	// two.example.org
+	// two.example.org
+}
+
+// Example_adminHandler shows that the state changing admin routes only take POST and need the AdminToken or a
+// verified client certificate. /metrics only takes GET and needs them too. The refresh is on /refresh and on / - other paths are not found.
+func Example_adminHandler() {
+	dir := newTestConfigDir("")
+	defer os.RemoveAll(dir)
+	defer installTestConfig(dir)()
+	mux := newAdminMux()
+	try := func(method, path, auth string, clientCert bool) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		if clientCert {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+		}
+		mux.ServeHTTP(w, r)
+		fmt.Println(method, path, w.Code, w.Header()["Allow"])
+	}
+	try("GET", "/reload", "Bearer sekret", false)
+	try("POST", "/reload", "", false)
+	try("POST", "/reload", "Bearer wrong", false)
+	try("POST", "/reload", "sekret", false)
+	try("POST", "/reload", "Bearer sekret", false)
+	try("POST", "/reload", "", true)
+	try("GET", "/generations", "Bearer sekret", false)
+	try("POST", "/generations", "Bearer sekret", false)
+	try("GET", "/pin", "Bearer sekret", false)
+	try("GET", "/release", "Bearer sekret", false)
+	try("GET", "/", "Bearer sekret", false)
+	try("PUT", "/", "Bearer sekret", false)
+	try("POST", "/", "", false)
+	try("GET", "/refresh", "Bearer sekret", false)
+	try("POST", "/refresh", "", false)
+	try("POST", "/unknown", "Bearer sekret", false)
+	try("POST", "/reload/", "Bearer sekret", false)
+	try("GET", "/metrics", "", false)
+	try("POST", "/metrics", "Bearer sekret", false)
+	try("GET", "/metrics", "Bearer sekret", false)
+	try("GET", "/health/ready", "", false)
+	try("GET", "/health/ready", "", true)
+
+	stateLock.Lock()
+	config.AdminToken = ""
+	stateLock.Unlock()
+	try("POST", "/reload", "Bearer ", false)
+	// Output:
+	// GET /reload 405 [POST]
+	// POST /reload 401 []
+	// POST /reload 401 []
+	// POST /reload 401 []
+	// POST /reload 200 []
+	// POST /reload 200 []
+	// GET /generations 405 [POST]
+	// POST /generations 200 []
+	// GET /pin 405 [POST]
+	// GET /release 405 [POST]
+	// GET / 405 [POST]
+	// PUT / 405 [POST]
+	// POST / 401 []
+	// GET /refresh 405 [POST]
+	// POST /refresh 401 []
+	// POST /unknown 404 []
+	// POST /reload/ 404 []
+	// GET /metrics 401 []
+	// POST /metrics 405 [GET]
+	// GET /metrics 200 []
+	// GET /health/ready 401 []
+	// GET /health/ready 200 []
+	// POST /reload 401 []
+}
+
+// Example_adminErrors shows that the admin routes return their errors as JSON with the status for the error
+func Example_adminErrors() {
+	dir := newTestConfigDir("")
+	defer os.RemoveAll(dir)
+	defer installTestConfig(dir)()
+	mux := newAdminMux()
+	try := func(method, path, auth string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		mux.ServeHTTP(w, r)
+		var e apiError
+		json.Unmarshal(w.Body.Bytes(), &e)
+		fmt.Println(w.Code, w.Header().Get("Content-Type"), e.Error, e.Message, e.RequestID != "")
+	}
+	try("GET", "/pin", "Bearer sekret")
+	try("POST", "/pin", "")
+	try("POST", "/pin?feed=nosuch.mddb", "Bearer sekret")
+	try("POST", "/release?feed=nosuch.mddb", "Bearer sekret")
+	// Output:
+	// 405 application/json method_not_allowed GET is not allowed - use POST false
+	// 401 application/json unauthorized a client certificate or the admin token is needed false
+	// 400 application/json bad_request pin: "nosuch.mddb" is not a metadata feed true
+	// 400 application/json bad_request release: "nosuch.mddb" is not a metadata feed true
+}
+
+// Example_deploymentFor shows that a request is served by the deployment for the host it was sent to and that
+// all other hosts get the default one
+func Example_deploymentFor() {
+	dir := newTestConfigDir(`Domain = "example.org"`)
+	defer os.RemoveAll(dir)
+	f, _ := os.OpenFile(dir+"/hybrid-config/hybrid-config.toml", os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString("[Hosts.\"wayf.example.net\"]\nDomain = \"example.net\"\n")
+	f.Close()
+	defer installTestConfig(dir)()
+
+	for _, host := range []string{"wayf.example.org", "wayf.example.net", "wayf.example.net:443", "other.example.com"} {
+		r := httptest.NewRequest("GET", "https://"+host+"/", nil)
+		d := deploymentFor(r)
+		fmt.Println(host, d.Domain, d.HubEntityID, d == runningState().defaultDeployment)
+	}
+	fmt.Println(len(runningState().deployments), len(mdqsOf(runningState().defaultDeployment, runningState().deployments)))
+	// Output:
+	// wayf.example.org example.org https://wayf.wayf.dk true
+	// wayf.example.net example.net https://wayf.wayf.dk false
+	// wayf.example.net:443 example.net https://wayf.wayf.dk false
+	// other.example.com example.org https://wayf.wayf.dk true
+	// 1 4
+}
+
+// Example_readiness shows the liveness and readiness endpoints - the components are only reported on the admin listener
+func Example_readiness() {
+	dir := newTestConfigDir("")
+	defer os.RemoveAll(dir)
+	defer installTestConfig(dir)()
+	setReady(true)
+	defer setReady(true)
+	probe := func(mux http.Handler, path string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer sekret") // only the admin listener needs it
+		mux.ServeHTTP(w, r)
+		var report healthReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		fmt.Println(path, w.Code, report.Status, len(report.Components))
+		for _, c := range report.Components {
+			if !c.OK || c.Name == "hsm" {
+				fmt.Println("  ", c.Name, c.OK, c.Critical, c.Detail)
+			}
+		}
+	}
+	front, admin := runningState().mux, newAdminMux()
+	probe(front, "/health/live")
+	probe(front, "/health/ready")
+	probe(admin, "/health/ready")
+	setReady(false)
+	probe(front, "/health/live")
+	probe(front, "/health/ready")
+	probe(admin, "/health/ready")
+
+	setReady(true)
+	stateLock.Lock()
+	config.GoEleven.SlotPassword, config.GoEleven.Maxsessions = "secret", "4"
+	stateLock.Unlock()
+	hsmCheck = func() error { return errors.New("CKR_TOKEN_NOT_PRESENT") }
+	defer func() { hsmCheck = goeleven.HSMStatus }()
+	probe(admin, "/health/ready")
+	// Output:
+	// /health/live 200 live 0
+	// /health/ready 200 ready 0
+	// /health/ready 200 ready 10
+	//    hsm true false not configured
+	// /health/live 200 live 0
+	// /health/ready 503 not ready 0
+	// /health/ready 503 not ready 10
+	//    serving false true draining
+	//    hsm true false not configured
+	// /health/ready 503 not ready 10
+	//    hsm false true CKR_TOKEN_NOT_PRESENT
+}
+
+// Example_hsmStatus shows that concurrent HSM probes share one call to the HSM - a caller that comes while a probe
+// is running gets the last result and only a probe that hangs for more than hsmProbeTimeout is a timeout
+func Example_hsmStatus() {
+	defer func() { hsmCheck = goeleven.HSMStatus }()
+	hsmProbe.lock.Lock()
+	hsmProbe.err, hsmProbe.completed = nil, false
+	hsmProbe.lock.Unlock()
+	release, calls := make(chan error), int32(0)
+	hsmCheck = func() error {
+		atomic.AddInt32(&calls, 1)
+		return <-release
+	}
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ { // no completed probe yet - all wait for the first one
+		go func() { results <- hsmStatus() }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	release <- nil
+	for i := 0; i < 3; i++ {
+		fmt.Println("first", <-results)
+	}
+
+	started := func() { // starts a probe and waits until it is calling the HSM
+		n := atomic.LoadInt32(&calls)
+		go func() { results <- hsmStatus() }()
+		for atomic.LoadInt32(&calls) == n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	started()
+	fmt.Println("while probing", hsmStatus())
+	release <- errors.New("CKR_DEVICE_ERROR")
+	fmt.Println("probe", <-results)
+
+	started()
+	fmt.Println("while probing", hsmStatus())
+	release <- nil
+	fmt.Println("probe", <-results)
+
+	started()
+	hsmProbe.lock.Lock()
+	hsmProbe.start = hsmProbe.start.Add(-hsmProbeTimeout) // pretend the HSM has hung for hsmProbeTimeout
+	hsmProbe.lock.Unlock()
+	fmt.Println("hanging", hsmStatus())
+	release <- nil
+	<-results
+	fmt.Println("calls", atomic.LoadInt32(&calls))
 	// Output:
-	// https://example.com/test
-	// https://example.com/test
-	// idp.entity.test
-	// idp.entity.test
+	// first <nil>
+	// first <nil>
+	// first <nil>
+	// while probing <nil>
+	// probe CKR_DEVICE_ERROR
+	// while probing CKR_DEVICE_ERROR
+	// probe <nil>
+	// hanging timeout
+	// calls 4
 }
 
 func PrintMemUsage() {
@@ -0,0 +1,162 @@
+package wayfhybrid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/wayf-dk/gosaml"
+	"github.com/wayf-dk/goxml"
+)
+
+type (
+	// logRecord - one structured log line - all lines share this schema, empty fields are left out
+	logRecord struct {
+		Time         string            `json:"time"`
+		Event        string            `json:"event"`
+		RequestID    string            `json:"request_id,omitempty"`
+		RemoteAddr   string            `json:"remote_addr,omitempty"`
+		Method       string            `json:"method,omitempty"`
+		Host         string            `json:"host,omitempty"`
+		Path         string            `json:"path,omitempty"`
+		Route        string            `json:"route,omitempty"`
+		Status       int               `json:"status,omitempty"`
+		Latency      float64           `json:"latency,omitempty"`
+		SP           string            `json:"sp,omitempty"`
+		IdP          string            `json:"idp,omitempty"`
+		ErrorClass   string            `json:"error_class,omitempty"`
+		Error        string            `json:"error,omitempty"`
+		ErrorContext []string          `json:"error_context,omitempty"`
+		Stack        string            `json:"stack,omitempty"`
+		Logtag       string            `json:"logtag,omitempty"`
+		Fields       map[string]string `json:"fields,omitempty"`
+	}
+
+	// structuredLogger writes logRecords as JSON - one per line
+	structuredLogger struct {
+		lock sync.Mutex
+		out  io.Writer
+	}
+
+	logRecordKey struct{}
+	routeKey     struct{}
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+)
+
+var (
+	logger = &structuredLogger{out: os.Stdout} // the legacy lines from the log package has stderr to themselves
+	logNow = time.Now
+
+	validRequestID = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+)
+
+// log writes rec - the time is set if it is empty
+func (l *structuredLogger) log(rec *logRecord) {
+	if rec.Time == "" {
+		rec.Time = logNow().UTC().Format(time.RFC3339Nano)
+	}
+	b, _ := json.Marshal(rec)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(append(b, '\n'))
+}
+
+// event writes a non access log line - the request id, SP and IdP are taken from r's logRecord if r is not nil
+func (l *structuredLogger) event(r *http.Request, event string, fields map[string]string) {
+	rec := &logRecord{Event: event, Fields: fields}
+	if r != nil {
+		req := logRecordFor(r)
+		rec.RequestID, rec.RemoteAddr, rec.SP, rec.IdP = req.RequestID, req.RemoteAddr, req.SP, req.IdP
+	}
+	l.log(rec)
+}
+
+// withLogRecord returns r with a new access logRecord in it's context.
+// The request id is taken from a valid incoming X-Request-ID header - otherwise a new one is made.
+func withLogRecord(r *http.Request) (*http.Request, *logRecord) {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newRequestID()
+	}
+	rec := &logRecord{
+		Event:      "access",
+		RequestID:  id,
+		RemoteAddr: clientIP(r),
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+	}
+	if route, ok := r.Context().Value(routeKey{}).(string); ok {
+		rec.Route = route
+	}
+	return r.WithContext(context.WithValue(r.Context(), logRecordKey{}, rec)), rec
+}
+
+// logRecordFor returns the logRecord for r - handlers use it to add the SP and IdP to the access log line.
+// Requests that did not come through an appHandler gets a throw away record.
+func logRecordFor(r *http.Request) *logRecord {
+	if rec, ok := r.Context().Value(logRecordKey{}).(*logRecord); ok {
+		return rec
+	}
+	return &logRecord{}
+}
+
+// requestID returns the correlation id for r
+func requestID(r *http.Request) string {
+	return logRecordFor(r).RequestID
+}
+
+// adoptRequestID makes id the correlation id for the rest of r - used when a login returns from the IdP
+func adoptRequestID(w http.ResponseWriter, r *http.Request, id string) {
+	if !validRequestID.MatchString(id) {
+		return
+	}
+	logRecordFor(r).RequestID = id
+	w.Header().Set(requestIDHeader, id)
+}
+
+// dumpFileIfTracing is gosaml.DumpFileIfTracing that logs the logtag of the dump with the request id
+func dumpFileIfTracing(r *http.Request, xp *goxml.Xp) {
+	if logtag := gosaml.DumpFileIfTracing(r, xp); logtag != "" {
+		logger.event(r, "dump", map[string]string{"logtag": logtag})
+	}
+}
+
+// withRoute makes the route name available for the access log
+func withRoute(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, name)))
+	})
+}
+
+// setError sets the error fields in rec
+func (rec *logRecord) setError(err error) {
+	if err == nil {
+		return
+	}
+	rec.ErrorClass = errorKinds[kindOf(err)].class
+	rec.Error = err.Error()
+	var x goxml.Werror
+	if errors.As(err, &x) {
+		rec.Error = x.FullError()
+		rec.ErrorContext = x.C
+		rec.Stack = x.Stack(5)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
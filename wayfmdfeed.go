@@ -0,0 +1,348 @@
+package wayfhybrid
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql" // the sqlite3 driver is registered by lmdq
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMetadataMaxSize is used if Conf.MetadataMaxSize is not set
+	defaultMetadataMaxSize = 512 << 20
+	// metadataSigMaxSize bounds the downloaded signatures and manifests
+	metadataSigMaxSize = 1 << 20
+)
+
+var (
+	sqliteMagic = []byte("SQLite format 3\x00")
+
+	errNotModified = errors.New("metadata feed: not modified")
+
+	feedRejections = newCounterVec("wayf_metadata_feed_rejected_total", "Downloaded metadata feeds that failed the checks by reason", "path", "reason")
+)
+
+// refreshMetadataFeed downloads the mddb at url to a temp file next to mddbpath and checks it - the temp file is
+// left for swapMetadata to install. A feed that fails the checks leaves the current mddb in place - as does a pinned one.
+func refreshMetadataFeed(conf Conf, mddbpath, url string) (feed feedReport, err error) {
+	feed = feedReport{Path: mddbpath, URL: url}
+	if feed.Pinned = pinnedGeneration(mddbpath); feed.Pinned != "" {
+		feed.NotModified = true
+		return
+	}
+	tempmddb, err := ioutil.TempFile(path.Dir(mddbpath), "")
+	if err != nil {
+		return
+	}
+	feed.temp = tempmddb.Name()
+	defer func() {
+		tempmddb.Close()
+		if err != nil || feed.NotModified {
+			os.Remove(feed.temp)
+		}
+	}()
+
+	etag, lastModified := feedValidators(mddbpath)
+	body, header, err := fetchMetadata(url, metadataMaxSize(conf), etag, lastModified)
+	if err == errNotModified {
+		feed.NotModified = true
+		return feed, nil
+	}
+	if err != nil {
+		return feed, rejectFeed(mddbpath, "download", err)
+	}
+	defer body.Close()
+	digest := sha256.New()
+	if feed.Size, err = io.Copy(io.MultiWriter(tempmddb, digest), body); err != nil {
+		return feed, rejectFeed(mddbpath, "download", err)
+	}
+	if err = tempmddb.Sync(); err != nil {
+		return
+	}
+	sum := digest.Sum(nil)
+	feed.SHA256 = hex.EncodeToString(sum)
+
+	if err = verifyMetadataSignature(conf, url, sum); err != nil {
+		return feed, rejectFeed(mddbpath, "signature", err)
+	}
+	if feed.Entities, err = checkMddb(feed.temp, feedTables(conf, mddbpath)); err != nil {
+		return feed, rejectFeed(mddbpath, "sqlite", err)
+	}
+	if err = checkEntityDrop(conf, mddbpath, feed.Entities); err != nil {
+		return feed, rejectFeed(mddbpath, "entities", err)
+	}
+	feed.etag, feed.lastModified = header.Get("ETag"), header.Get("Last-Modified")
+	return
+}
+
+// rejectFeed counts and wraps the reason a feed was not used
+func rejectFeed(mddbpath, reason string, err error) error {
+	feedRejections.inc(mddbpath, reason)
+	return fmt.Errorf("metadata feed %s: %s", mddbpath, err)
+}
+
+// metadataMaxSize returns the max size in bytes of a downloaded mddb
+func metadataMaxSize(conf Conf) int64 {
+	if conf.MetadataMaxSize > 0 {
+		return conf.MetadataMaxSize
+	}
+	return defaultMetadataMaxSize
+}
+
+// fetchMetadata gets url - anything but a 200 is an error and the returned body fails if it is longer than maxSize.
+// If etag or lastModified is set the request is conditional and a 304 is errNotModified.
+func fetchMetadata(url string, maxSize int64, etag, lastModified string) (io.ReadCloser, http.Header, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && (etag != "" || lastModified != ""):
+		resp.Body.Close()
+		return nil, resp.Header, errNotModified
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("%s: status %s", url, resp.Status)
+	case resp.ContentLength > maxSize:
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("%s: %d bytes is more than the max %d", url, resp.ContentLength, maxSize)
+	}
+	return &limitedBody{resp.Body, url, maxSize}, resp.Header, nil
+}
+
+// limitedBody fails instead of silently truncating when more than max bytes are read
+type limitedBody struct {
+	io.ReadCloser
+	url string
+	max int64
+}
+
+func (l *limitedBody) Read(p []byte) (n int, err error) {
+	n, err = l.ReadCloser.Read(p)
+	l.max -= int64(n)
+	if l.max < 0 {
+		return n, fmt.Errorf("%s: more than the max %d bytes", l.url, l.max+int64(n))
+	}
+	return
+}
+
+// fetchSmall returns the body of url - for signatures and manifests
+func fetchSmall(url string) ([]byte, error) {
+	body, _, err := fetchMetadata(url, metadataSigMaxSize, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// checkMddb checks that the file at name is a sqlite database with the entity_ and lookup_ tables for tables and returns the number of entities.
+// If tables is empty it must have at least one pair.
+func checkMddb(name string, tables []string) (entities int, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	header := make([]byte, len(sqliteMagic))
+	_, err = io.ReadFull(f, header)
+	f.Close()
+	if err != nil || !bytes.Equal(header, sqliteMagic) {
+		return 0, errors.New("not a sqlite database")
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+name+"?mode=ro")
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	var check string
+	if err = db.QueryRow("pragma quick_check").Scan(&check); err != nil {
+		return
+	}
+	if check != "ok" {
+		return 0, fmt.Errorf("quick_check: %s", check)
+	}
+
+	if len(tables) == 0 {
+		rows, err := db.Query("select substr(name, 8) from sqlite_master where type = 'table' and name like 'entity\\_%' escape '\\'")
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var table string
+			rows.Scan(&table)
+			tables = append(tables, table)
+		}
+		rows.Close()
+		if len(tables) == 0 {
+			return 0, errors.New("no entity_ tables")
+		}
+	}
+	for _, table := range tables {
+		for _, t := range []string{"entity_" + table, "lookup_" + table} {
+			var n int
+			if err = db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = ?", t).Scan(&n); err != nil {
+				return
+			}
+			if n == 0 {
+				return 0, fmt.Errorf("table %s is missing", t)
+			}
+		}
+		var n int
+		if err = db.QueryRow("select count(*) from entity_" + table).Scan(&n); err != nil {
+			return
+		}
+		entities += n
+	}
+	return
+}
+
+// feedTables returns the tables of the configured metadata sets that are read from mddbpath
+func feedTables(conf Conf, mddbpath string) (tables []string) {
+	seen := map[string]bool{}
+	names, hcs := hostConfs(conf)
+	for _, set := range mddbConfigs(names, hcs) {
+		if filepath.Clean(mddbFile(set.Path)) == filepath.Clean(mddbpath) && !seen[set.Table] {
+			seen[set.Table] = true
+			tables = append(tables, set.Table)
+		}
+	}
+	return
+}
+
+// checkEntityDrop compares entities with the number in the current mddb at mddbpath - it must not drop more than Conf.MetadataMaxEntityDrop percent.
+// A missing or unreadable current mddb is not compared with.
+func checkEntityDrop(conf Conf, mddbpath string, entities int) error {
+	if conf.MetadataMaxEntityDrop <= 0 {
+		return nil
+	}
+	current, err := checkMddb(mddbpath, feedTables(conf, mddbpath))
+	if err != nil || current == 0 {
+		return nil
+	}
+	if drop := (current - entities) * 100 / current; drop > conf.MetadataMaxEntityDrop {
+		return fmt.Errorf("entities dropped %d%% from %d to %d - the max is %d%%", drop, current, entities, conf.MetadataMaxEntityDrop)
+	}
+	return nil
+}
+
+// verifyMetadataSignature checks the sha256 digest of the feed at url if Conf.MetadataSigningKey is set.
+// With a Conf.MetadataManifestURL the digest must be in the manifest - sha256sum format - and the manifest is signed in MetadataManifestURL.sig.
+// Without it the feed itself is signed in url.sig. The signatures are as made by openssl dgst -sha256 -sign - raw or base64.
+func verifyMetadataSignature(conf Conf, url string, digest []byte) error {
+	if conf.MetadataSigningKey == "" {
+		return nil
+	}
+	key, err := loadPublicKey(conf.MetadataSigningKey)
+	if err != nil {
+		return err
+	}
+	signedURL, signedDigest := url, digest
+	if manifestURL := conf.MetadataManifestURL; manifestURL != "" {
+		manifest, err := fetchSmall(manifestURL)
+		if err != nil {
+			return err
+		}
+		if err = manifestHas(manifest, path.Base(url), digest); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(manifest)
+		signedURL, signedDigest = manifestURL, sum[:]
+	}
+	sig, err := fetchSmall(signedURL + ".sig")
+	if err != nil {
+		return err
+	}
+	if err = verifyDigest(key, signedDigest, sig); err != nil {
+		return fmt.Errorf("%s: %s", signedURL, err)
+	}
+	return nil
+}
+
+// manifestHas checks that manifest has the digest for name - lines are <hex sha256> <name> with an optional * before the name
+func manifestHas(manifest []byte, name string, digest []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.TrimPrefix(fields[1], "*") != name {
+			continue
+		}
+		if sum, err := hex.DecodeString(fields[0]); err != nil || !bytes.Equal(sum, digest) {
+			return fmt.Errorf("manifest: sha256 of %s does not match", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("manifest: %s not found", name)
+}
+
+// loadPublicKey reads the pinned key - a PEM public key or certificate
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		return cert.PublicKey, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM type %s", file, block.Type)
+}
+
+// verifyDigest verifies sig of the sha256 digest with an RSA PKCS #1 v1.5 or ECDSA key
+func verifyDigest(key crypto.PublicKey, digest, sig []byte) error {
+	if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig))); err == nil {
+		sig = decoded
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig)
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(k, digest, sig) {
+			return nil
+		}
+		return errors.New("ecdsa: verification error")
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
@@ -0,0 +1,249 @@
+package wayfhybrid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// mdGeneration - an mddb that has been installed for a feed
+	mdGeneration struct {
+		Name   string    `json:"name"`
+		Time   time.Time `json:"time"`
+		SHA256 string    `json:"sha256"`
+		Size   int64     `json:"size"`
+		Live   bool      `json:"live"`
+	}
+
+	// feedGenerations - the generations of a feed - the newest first
+	feedGenerations struct {
+		Path        string         `json:"path"`
+		Pinned      string         `json:"pinned,omitempty"`
+		Generations []mdGeneration `json:"generations"`
+	}
+)
+
+const (
+	// defaultMetadataGenerations is used if Conf.MetadataGenerations is not set
+	defaultMetadataGenerations = 3
+	generationTimeFormat       = "20060102T150405Z"
+	pinFile                    = "pinned"
+)
+
+var (
+	// generationName is <time>-<sha256 of the mddb>.mddb
+	generationName = regexp.MustCompile(`^(\d{8}T\d{6}Z)-([a-f0-9]{64})\.mddb$`)
+)
+
+// generationsDir returns the directory with the generations of the mddb at path
+func generationsDir(path string) string {
+	return path + ".generations"
+}
+
+// metadataGenerations returns how many generations of each mddb to keep
+func metadataGenerations(conf Conf) int {
+	if conf.MetadataGenerations > 0 {
+		return conf.MetadataGenerations
+	}
+	return defaultMetadataGenerations
+}
+
+// addGeneration saves the installed mddb at path as a new generation from t - a hard link so it takes no extra space while it is live.
+// The oldest generations beyond Conf.MetadataGenerations are removed - the live and the pinned ones are always kept.
+func addGeneration(conf Conf, path, sha256 string, t time.Time) (err error) {
+	dir := generationsDir(path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	gens, err := listGenerations(path)
+	if err != nil {
+		return
+	}
+	for _, gen := range gens.Generations {
+		if gen.SHA256 == sha256 { // the same mddb again - only keep the newest
+			os.Remove(dir + "/" + gen.Name)
+		}
+	}
+	name := t.UTC().Format(generationTimeFormat) + "-" + sha256 + ".mddb"
+	if err = os.Link(path, dir+"/"+name); err != nil {
+		return
+	}
+	if gens, err = listGenerations(path); err != nil {
+		return
+	}
+	for i, gen := range gens.Generations {
+		if i >= metadataGenerations(conf) && !gen.Live && gen.Name != gens.Pinned {
+			os.Remove(dir + "/" + gen.Name)
+		}
+	}
+	return
+}
+
+// addLiveGenerations saves the live mddbs of the feeds that are not a generation as one - from when they were installed.
+// Called at startup so the mddbs we started with can be pinned again after a refresh has replaced them.
+func addLiveGenerations(conf Conf) {
+	for _, feed := range conf.MetadataFeeds {
+		if err := addLiveGeneration(conf, feed.Path); err != nil {
+			log.Printf("metadata generations: %s: %s\n", feed.Path, err)
+		}
+	}
+}
+
+func addLiveGeneration(conf Conf, path string) (err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	gens, err := listGenerations(path)
+	if err != nil {
+		return
+	}
+	for _, gen := range gens.Generations {
+		if gen.Live {
+			return
+		}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	digest := sha256.New()
+	if _, err = io.Copy(digest, f); err != nil {
+		return
+	}
+	return addGeneration(conf, path, hex.EncodeToString(digest.Sum(nil)), fi.ModTime())
+}
+
+// listGenerations returns the generations of the mddb at path
+func listGenerations(path string) (gens feedGenerations, err error) {
+	gens = feedGenerations{Path: path, Pinned: pinnedGeneration(path), Generations: []mdGeneration{}}
+	files, err := ioutil.ReadDir(generationsDir(path))
+	if os.IsNotExist(err) {
+		return gens, nil
+	}
+	if err != nil {
+		return
+	}
+	live, _ := os.Stat(path)
+	for _, fi := range files {
+		m := generationName.FindStringSubmatch(fi.Name())
+		if m == nil {
+			continue
+		}
+		t, _ := time.Parse(generationTimeFormat, m[1])
+		gens.Generations = append(gens.Generations, mdGeneration{Name: fi.Name(), Time: t, SHA256: m[2], Size: fi.Size(), Live: live != nil && os.SameFile(live, fi)})
+	}
+	sort.Slice(gens.Generations, func(i, j int) bool { return gens.Generations[i].Name > gens.Generations[j].Name })
+	return
+}
+
+// pinnedGeneration returns the generation the mddb at path is pinned to - "" if it is not pinned
+func pinnedGeneration(path string) string {
+	pin, err := ioutil.ReadFile(generationsDir(path) + "/" + pinFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(pin))
+}
+
+// pinGeneration installs the generation name of the feed at path and pins it - the refreshes leaves the feed alone until the pin is released.
+// The generation is checked and swapped in as a downloaded feed would be - with the config running when the pin has the metadataUpdateGuard.
+func pinGeneration(path, name string) (err error) {
+	metadataUpdateGuard <- 1 // no refreshes while we swap
+	defer func() { <-metadataUpdateGuard }()
+	conf := runningState().config
+	if !isFeed(conf, path) {
+		return newError(badRequestError, fmt.Errorf("pin: %q is not a metadata feed", path))
+	}
+	dir := generationsDir(path)
+	if !generationName.MatchString(name) {
+		return newError(badRequestError, fmt.Errorf("pin: %q is not a generation", name))
+	}
+	if _, err = os.Stat(dir + "/" + name); err != nil {
+		return newError(badRequestError, fmt.Errorf("pin: %s", err))
+	}
+
+	temp := path + ".pin"
+	os.Remove(temp)
+	if err = os.Link(dir+"/"+name, temp); err != nil {
+		return
+	}
+	defer os.Remove(temp) // only left if the swap failed - the sets are opened on path once temp is renamed there
+	if err = swapMetadata(conf, []feedReport{{Path: path, temp: temp}}); err != nil {
+		return
+	}
+	setFeedValidators(path, "", "") // the live mddb is no longer the one the validators are for
+	return ioutil.WriteFile(dir+"/"+pinFile, []byte(name+"\n"), 0644)
+}
+
+// releasePin removes the pin of the feed at path - the next refresh installs the feed again.
+// The pin is only removed when no refresh or pin holds the metadataUpdateGuard.
+func releasePin(path string) error {
+	metadataUpdateGuard <- 1 // not while a refresh or a pin is under way
+	defer func() { <-metadataUpdateGuard }()
+	conf := runningState().config
+	if !isFeed(conf, path) {
+		return newError(badRequestError, fmt.Errorf("release: %q is not a metadata feed", path))
+	}
+	if err := os.Remove(generationsDir(path) + "/" + pinFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isFeed tells if path is the path of one of the MetadataFeeds in conf
+func isFeed(conf Conf, path string) bool {
+	for _, feed := range conf.MetadataFeeds {
+		if feed.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// generationsService returns the generations of all the feeds as JSON
+func generationsService(w http.ResponseWriter, r *http.Request) (err error) {
+	list := []feedGenerations{}
+	for _, feed := range stateFor(r).config.MetadataFeeds {
+		gens, err := listGenerations(feed.Path)
+		if err != nil {
+			return err
+		}
+		list = append(list, gens)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(list)
+}
+
+// pinService pins the feed with the path in the form value feed to the generation in the form value generation
+func pinService(w http.ResponseWriter, r *http.Request) (err error) {
+	r.ParseForm()
+	if err = pinGeneration(r.Form.Get("feed"), r.Form.Get("generation")); err != nil {
+		return
+	}
+	return generationsService(w, r)
+}
+
+// releaseService releases the pin of the feed with the path in the form value feed
+func releaseService(w http.ResponseWriter, r *http.Request) (err error) {
+	r.ParseForm()
+	if err = releasePin(r.Form.Get("feed")); err != nil {
+		return
+	}
+	return generationsService(w, r)
+}
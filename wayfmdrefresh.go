@@ -0,0 +1,230 @@
+package wayfhybrid
+
+import (
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// feedState - the schedule and the conditional GET validators of a metadata feed
+	feedState struct {
+		etag, lastModified                string
+		lastSuccess, lastFailure, nextRun time.Time
+		lastError                         string
+		failures                          int
+	}
+
+	// feedStatus - the feedState reported by the readiness endpoint
+	feedStatus struct {
+		LastSuccess string `json:"last_success,omitempty"`
+		LastFailure string `json:"last_failure,omitempty"`
+		LastError   string `json:"last_error,omitempty"`
+		NextRun     string `json:"next_run,omitempty"`
+		Failures    int    `json:"failures,omitempty"`
+		Pinned      string `json:"pinned,omitempty"`
+	}
+)
+
+const (
+	// metadataRetryMin is the first backoff after a failed refresh - it doubles for each failure up to the feed's interval
+	metadataRetryMin = 30 * time.Second
+	// metadataIdleWait is how often the scheduler looks for feeds when none are scheduled - a reload might add some
+	metadataIdleWait = time.Minute
+)
+
+var (
+	feedStates     = map[string]*feedState{}
+	feedStatesLock sync.Mutex
+
+	feedNow = time.Now
+	// feedJitter spreads the refreshes by +/- 10% so the nodes do not hit the feed at the same time
+	feedJitter = func(d time.Duration) time.Duration {
+		if d < 10 {
+			return d
+		}
+		return d - d/10 + time.Duration(rand.Int63n(int64(d/5)))
+	}
+
+	feedLastSuccess = newGaugeFunc("wayf_metadata_feed_last_success_timestamp_seconds", "Time of the last successful refresh of each metadata feed", feedTimes(func(s *feedState) time.Time { return s.lastSuccess }), "path")
+	feedLastFailure = newGaugeFunc("wayf_metadata_feed_last_failure_timestamp_seconds", "Time of the last failed refresh of each metadata feed", feedTimes(func(s *feedState) time.Time { return s.lastFailure }), "path")
+	feedNextRun     = newGaugeFunc("wayf_metadata_feed_next_run_timestamp_seconds", "Time of the next scheduled refresh of each metadata feed", feedTimes(func(s *feedState) time.Time { return s.nextRun }), "path")
+	feedFailures    = newGaugeFunc("wayf_metadata_feed_failures", "Consecutive failed refreshes of each metadata feed", func() map[string]float64 {
+		feedStatesLock.Lock()
+		defer feedStatesLock.Unlock()
+		failures := map[string]float64{}
+		for path, s := range feedStates {
+			failures[path] = float64(s.failures)
+		}
+		return failures
+	}, "path")
+	feedPins = newGaugeFunc("wayf_metadata_feed_pinned", "Metadata feeds that are pinned to a generation - the refreshes leave them alone", func() map[string]float64 {
+		stateLock.RLock()
+		feeds := config.MetadataFeeds
+		stateLock.RUnlock()
+		pins := map[string]float64{}
+		for _, feed := range feeds {
+			if pinnedGeneration(feed.Path) != "" {
+				pins[feed.Path] = 1
+			} else {
+				pins[feed.Path] = 0
+			}
+		}
+		return pins
+	}, "path")
+)
+
+// metadataScheduler refreshes each metadata feed when it is due - it runs for the life of the process
+func metadataScheduler() {
+	for {
+		time.Sleep(runDueFeeds(feedNow()))
+	}
+}
+
+// runDueFeeds refreshes the feeds that are due at now and returns how long to wait for the next one.
+// A feed is first scheduled one interval from when it is seen - it was refreshed at startup.
+func runDueFeeds(now time.Time) (wait time.Duration) {
+	conf := runningState().config
+
+	wait = metadataIdleWait
+	for _, feed := range conf.MetadataFeeds {
+		interval := metadataRefreshInterval(conf, feed.Path)
+		if interval <= 0 {
+			continue
+		}
+		feedStatesLock.Lock()
+		s := feedStateFor(feed.Path)
+		if s.nextRun.IsZero() {
+			s.nextRun = now.Add(feedJitter(interval))
+		}
+		due := !now.Before(s.nextRun)
+		feedStatesLock.Unlock()
+
+		if due {
+			if report, _ := refreshFeeds(feed.Path); report.Status == "ignored" { // a refresh from the admin endpoint is running
+				feedStatesLock.Lock()
+				feedStateFor(feed.Path).nextRun = now.Add(metadataRetryMin)
+				feedStatesLock.Unlock()
+			}
+		}
+
+		feedStatesLock.Lock()
+		if next := feedStateFor(feed.Path).nextRun.Sub(now); next < wait {
+			wait = next
+		}
+		feedStatesLock.Unlock()
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return
+}
+
+// metadataRefreshInterval returns the refresh interval of the feed at path - Conf.MetadataRefreshIntervals or else Conf.MetadataRefresh
+func metadataRefreshInterval(conf Conf, path string) time.Duration {
+	if interval, ok := conf.MetadataRefreshIntervals[path]; ok {
+		return interval
+	}
+	return conf.MetadataRefresh
+}
+
+// feedDone records the result of refreshing the feed at path and schedules the next refresh - after a failure with exponential backoff
+func feedDone(conf Conf, path string, err error) {
+	now := feedNow()
+	interval := metadataRefreshInterval(conf, path)
+	feedStatesLock.Lock()
+	defer feedStatesLock.Unlock()
+	s := feedStateFor(path)
+	if err == nil {
+		s.lastSuccess, s.failures = now, 0
+		if interval > 0 {
+			s.nextRun = now.Add(feedJitter(interval))
+		}
+		return
+	}
+	s.lastFailure, s.lastError = now, err.Error()
+	s.failures++
+	backoff := metadataRetryMin
+	for i := 1; i < s.failures && backoff < interval; i++ {
+		backoff *= 2
+	}
+	if interval > metadataRetryMin && backoff > interval {
+		backoff = interval
+	}
+	s.nextRun = now.Add(feedJitter(backoff))
+}
+
+// feedPinned schedules the next refresh of the pinned feed at path - it was left alone, so neither a success nor a failure is recorded
+func feedPinned(conf Conf, path string) {
+	interval := metadataRefreshInterval(conf, path)
+	feedStatesLock.Lock()
+	defer feedStatesLock.Unlock()
+	if interval > 0 {
+		feedStateFor(path).nextRun = feedNow().Add(feedJitter(interval))
+	}
+}
+
+// feedValidators returns the ETag and Last-Modified from the last download of the feed at path - if the mddb is still there
+func feedValidators(path string) (etag, lastModified string) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	feedStatesLock.Lock()
+	defer feedStatesLock.Unlock()
+	s := feedStateFor(path)
+	return s.etag, s.lastModified
+}
+
+func setFeedValidators(path, etag, lastModified string) {
+	feedStatesLock.Lock()
+	defer feedStatesLock.Unlock()
+	s := feedStateFor(path)
+	s.etag, s.lastModified = etag, lastModified
+}
+
+// feedStateFor returns the state of the feed at path - feedStatesLock must be held
+func feedStateFor(path string) *feedState {
+	s, ok := feedStates[path]
+	if !ok {
+		s = &feedState{}
+		feedStates[path] = s
+	}
+	return s
+}
+
+// feedStatusFor returns the status of the feed at path for the readiness endpoint
+func feedStatusFor(path string) *feedStatus {
+	pinned := pinnedGeneration(path)
+	feedStatesLock.Lock()
+	defer feedStatesLock.Unlock()
+	s, ok := feedStates[path]
+	if !ok && pinned == "" {
+		return nil
+	}
+	if !ok {
+		s = &feedState{}
+	}
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	return &feedStatus{LastSuccess: format(s.lastSuccess), LastFailure: format(s.lastFailure), LastError: s.lastError, NextRun: format(s.nextRun), Failures: s.failures, Pinned: pinned}
+}
+
+// feedTimes returns a collector for a time in the feedStates as unix timestamps
+func feedTimes(field func(*feedState) time.Time) func() map[string]float64 {
+	return func() map[string]float64 {
+		feedStatesLock.Lock()
+		defer feedStatesLock.Unlock()
+		times := map[string]float64{}
+		for path, s := range feedStates {
+			if t := field(s); !t.IsZero() {
+				times[path] = float64(t.UnixNano()) / 1e9
+			}
+		}
+		return times
+	}
+}
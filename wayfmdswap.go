@@ -0,0 +1,195 @@
+package wayfhybrid
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wayf-dk/godiscoveryservice"
+	"github.com/wayf-dk/lmdq"
+)
+
+const (
+	// metadataRetireDelay is how long the replaced metadata sets are kept open for the requests in flight
+	metadataRetireDelay = 5 * time.Minute
+)
+
+var (
+	metadataSwaps = newCounterVec("wayf_metadata_swaps_total", "Metadata refreshes by result - swapped or kept if the new metadata sets failed", "result")
+)
+
+// swapMetadata installs the downloaded mddbs of feeds. The running deployments are copied with the metadata sets read
+// from the feeds replaced by sets opened on the downloaded files - which checks eg. that the HubEntityID resolves in the
+// hub - and those are closed again before the files are renamed into place. The running deployments are then copied
+// again with sets opened on the installed mddbs and switched to in one go - a set opened on a temp file would keep its
+// path for the new connections of its pool after the rename. The copies share everything else, eg. the parsed
+// templates, with the running deployments. If anything fails the current mddbs are left - or put back - and the
+// running deployments keep serving from the sets they have. At startup, before there are any deployments, the sets
+// are only checked. conf is the config the caller took with the metadataUpdateGuard.
+func swapMetadata(conf Conf, feeds []feedReport) (err error) {
+	running := runningState()
+	temps := map[string]string{} // the downloaded file by the mddb it replaces
+	for _, feed := range feeds {
+		temps[filepath.Clean(feed.Path)] = feed.temp
+	}
+	replaced := []*lmdq.MDQ{}
+	for _, mdq := range mdqsOf(running.defaultDeployment, running.deployments) {
+		if _, ok := temps[filepath.Clean(mddbFile(mdq.Path))]; ok {
+			replaced = append(replaced, mdq)
+		}
+	}
+
+	if running.defaultDeployment == nil { // at startup the deployments are made after the first refresh
+		if problems := checkMetadata(withTempMddbs(conf, temps)); len(problems) > 0 {
+			metadataSwaps.inc("kept")
+			return fmt.Errorf("metadata: %s - keeping the current metadata", joinErrors(problems))
+		}
+	} else if len(replaced) > 0 {
+		sets, err := openMdqs(replaced, temps)
+		if err == nil {
+			_, _, err = running.withMdqs(sets)
+			closeMdqs(setsOf(sets))
+		}
+		if err != nil {
+			metadataSwaps.inc("kept")
+			return fmt.Errorf("metadata: %s - keeping the current metadata", err)
+		}
+	}
+
+	installed := []string{}
+	defer func() {
+		if err != nil {
+			for _, path := range installed {
+				restoreMddb(path)
+			}
+		}
+	}()
+	for _, feed := range feeds {
+		if err = installMddb(feed.Path, feed.temp); err != nil {
+			return
+		}
+		installed = append(installed, feed.Path)
+	}
+
+	if len(replaced) == 0 { // no deployment reads from the feeds - or there are none yet
+		return
+	}
+	sets, err := openMdqs(replaced, nil)
+	if err != nil {
+		metadataSwaps.inc("kept")
+		return fmt.Errorf("metadata: %s - keeping the current metadata", err)
+	}
+	def, hosts, err := running.withMdqs(sets)
+	if err != nil {
+		closeMdqs(setsOf(sets))
+		metadataSwaps.inc("kept")
+		return fmt.Errorf("metadata: %s - keeping the current metadata", err)
+	}
+	stateLock.Lock()
+	defaultDeployment, deployments = def, hosts
+	stateLock.Unlock()
+	godiscoveryservice.MetadataUpdated()
+	metadataSwaps.inc("swapped")
+	retireMdqs(replaced)
+	return
+}
+
+// withMdqs returns copies of the deployments of st that use the metadata sets in sets instead of the ones they replace -
+// hosts that share a deployment share the copy
+func (st *hybridState) withMdqs(sets map[*lmdq.MDQ]*lmdq.MDQ) (def *deployment, hosts map[string]*deployment, err error) {
+	if def, err = st.defaultDeployment.withMdqs(sets); err != nil {
+		return nil, nil, err
+	}
+	copies := map[*deployment]*deployment{st.defaultDeployment: def}
+	hosts = map[string]*deployment{}
+	for host, d := range st.deployments {
+		if copies[d] == nil {
+			if copies[d], err = d.withMdqs(sets); err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", host, err)
+			}
+		}
+		hosts[host] = copies[d]
+	}
+	return
+}
+
+// openMdqs opens a new metadata set for each of mdqs with the same path, table and rev - on the downloaded file in temps
+// if the set reads from an mddb in temps. If one fails to open the others are closed again.
+func openMdqs(mdqs []*lmdq.MDQ, temps map[string]string) (sets map[*lmdq.MDQ]*lmdq.MDQ, err error) {
+	sets = map[*lmdq.MDQ]*lmdq.MDQ{}
+	for _, mdq := range mdqs {
+		path := mdq.Path
+		if t, ok := temps[filepath.Clean(mddbFile(path))]; ok {
+			path = strings.Replace(path, mddbFile(path), t, 1)
+		}
+		set := &lmdq.MDQ{Path: path, Table: mdq.Table, Rev: mdq.Rev, Short: mdq.Short}
+		sets[mdq] = set
+		if err = set.Open(); err != nil {
+			closeMdqs(setsOf(sets))
+			return nil, fmt.Errorf("metadata %s: %s", mdq.Short, err)
+		}
+	}
+	return
+}
+
+// setsOf returns the new sets of the map made by openMdqs
+func setsOf(sets map[*lmdq.MDQ]*lmdq.MDQ) (mdqs []*lmdq.MDQ) {
+	for _, set := range sets {
+		mdqs = append(mdqs, set)
+	}
+	return
+}
+
+// withTempMddbs returns conf with the paths of the metadata sets read from the mddbs in temps changed to the temp files
+func withTempMddbs(conf Conf, temps map[string]string) Conf {
+	temp := func(c mdConf) mdConf {
+		if t, ok := temps[filepath.Clean(mddbFile(c.Path))]; ok {
+			c.Path = strings.Replace(c.Path, mddbFile(c.Path), t, 1)
+		}
+		return c
+	}
+	conf.Hub, conf.Internal, conf.ExternalIDP, conf.ExternalSP = temp(conf.Hub), temp(conf.Internal), temp(conf.ExternalIDP), temp(conf.ExternalSP)
+	hosts := map[string]hostConf{}
+	for name, hc := range conf.Hosts {
+		hc.Hub, hc.Internal, hc.ExternalIDP, hc.ExternalSP = temp(hc.Hub), temp(hc.Internal), temp(hc.ExternalIDP), temp(hc.ExternalSP)
+		hosts[name] = hc
+	}
+	conf.Hosts = hosts
+	return conf
+}
+
+// installMddb renames temp to path - the current mddb is kept as path.prev so restoreMddb can put it back
+func installMddb(path, temp string) error {
+	prev := path + ".prev"
+	os.Remove(prev)
+	if err := os.Link(path, prev); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// restoreMddb puts the mddb saved by installMddb back - if there was none the new one is removed
+func restoreMddb(path string) {
+	if err := os.Rename(path+".prev", path); os.IsNotExist(err) {
+		os.Remove(path)
+	}
+}
+
+// retireMdqs closes the databases of mdqs when the requests in flight are done with them - the replaced mddbs are
+// deleted and the space is only freed when they are closed
+func retireMdqs(mdqs []*lmdq.MDQ) {
+	if len(mdqs) == 0 {
+		return
+	}
+	time.AfterFunc(metadataRetireDelay, func() { closeMdqs(mdqs) })
+}
+
+// closeMdqs closes the databases of mdqs now - lookups on them fail from then on. Each is closed with its lock held as Open
+// does, and its Path is left alone as the readiness checks may read it.
+func closeMdqs(mdqs []*lmdq.MDQ) {
+	for _, mdq := range mdqs {
+		mdq.Close()
+	}
+}
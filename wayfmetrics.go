@@ -0,0 +1,329 @@
+package wayfhybrid
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wayf-dk/gosaml"
+	"github.com/wayf-dk/goxml"
+	"github.com/wayf-dk/lmdq"
+)
+
+type (
+	// metric is anything that can write itself in the Prometheus text format
+	metric interface {
+		write(w io.Writer)
+	}
+
+	// counterVec is a counter with labels - maxSeries > 0 limits the number of label sets, the rest are counted as other
+	counterVec struct {
+		name, help string
+		labels     []string
+		lock       sync.Mutex
+		values     map[string]float64 // keyed by the label values joined by labelSep
+		maxSeries  int
+	}
+
+	// gaugeVec is a gauge with labels
+	gaugeVec struct {
+		counterVec
+	}
+
+	// gaugeFunc is a gauge with labels where the values are collected when the metrics are written
+	gaugeFunc struct {
+		name, help string
+		labels     []string
+		collect    func() map[string]float64 // keyed by the label values joined by labelSep
+	}
+
+	// countingMd is a gosaml.Md that counts the cache hits and misses of the lmdq.MDQ it wraps
+	countingMd struct {
+		mdq *lmdq.MDQ
+	}
+
+	// histogramVec is a histogram with labels
+	histogramVec struct {
+		name, help string
+		labels     []string
+		buckets    []float64
+		lock       sync.Mutex
+		counts     map[string][]uint64 // per bucket - not cumulative
+		sums       map[string]float64
+	}
+)
+
+const (
+	labelSep       = "\xff"
+	otherLabel     = "other"
+	maxLoginSeries = 5000
+	mdqCacheTTL    = time.Hour // lmdq's cacheduration
+)
+
+var (
+	requestsTotal       = newCounterVec("wayf_requests_total", "Requests by route and outcome - ok or the error class", "route", "outcome")
+	requestDuration     = newHistogramVec("wayf_request_duration_seconds", "Request latency by route", latencyBuckets, "route")
+	loginsTotal         = newCounterVec("wayf_logins_total", "Logins by IdP and SP - limited to maxLoginSeries pairs, the rest are counted as other", "idp", "sp").limit(maxLoginSeries)
+	mdqLookups          = newCounterVec("wayf_mdq_lookups_total", "Metadata lookups by metadata set and cache result", "set", "result")
+	feedAge             = newGaugeFunc("wayf_metadata_feed_age_seconds", "Age of the mddb of each metadata feed", feedAges, "path")
+	feedRefreshDuration = newGaugeVec("wayf_metadata_refresh_duration_seconds", "Duration of the last refresh of each metadata feed", "path")
+	signingDuration     = newHistogramVec("wayf_signing_duration_seconds", "Signing latency by key backend - hsm or software", latencyBuckets, "backend")
+	signingErrors       = newCounterVec("wayf_signing_errors_total", "Signing errors by key backend - hsm or software", "backend")
+	cookieSize          = newHistogramVec("wayf_cookie_size_bytes", "Size of the SLO and SSO2- cookies", sizeBuckets, "cookie")
+
+	// lmdq's cache key - sha1 of the entityID or location unless it already is one
+	mdqHexKey = regexp.MustCompile("^[a-fA-F0-9]+$")
+)
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets    = []float64{256, 512, 1024, 2048, 3072, 4096, 6144, 8192}
+)
+
+var (
+	metricsLock sync.Mutex
+	metrics     []metric
+)
+
+func register(m metric) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metrics = append(metrics, m)
+}
+
+func newCounterVec(name, help string, labels ...string) (c *counterVec) {
+	c = &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(c)
+	return
+}
+
+// limit sets the max number of label sets for c
+func (c *counterVec) limit(maxSeries int) *counterVec {
+	c.maxSeries = maxSeries
+	return c
+}
+
+// inc increments the counter for the given label values - must be in the same order as the labels
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[c.key(labelValues)] += v
+}
+
+// key returns the key for labelValues - the other key if c already has maxSeries label sets
+func (c *counterVec) key(labelValues []string) string {
+	k := strings.Join(labelValues, labelSep)
+	if _, ok := c.values[k]; !ok && c.maxSeries > 0 && len(c.values) >= c.maxSeries {
+		others := make([]string, len(c.labels))
+		for i := range others {
+			others[i] = otherLabel
+		}
+		k = strings.Join(others, labelSep)
+	}
+	return k
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.writeAs(w, "counter")
+}
+
+func (c *counterVec) writeAs(w io.Writer, typ string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, typ)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, labelPairs(c.labels, k), c.values[k])
+	}
+}
+
+func newGaugeVec(name, help string, labels ...string) (g *gaugeVec) {
+	g = &gaugeVec{counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}}
+	register(g)
+	return
+}
+
+// set sets the gauge for the given label values
+func (g *gaugeVec) set(v float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[g.key(labelValues)] = v
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	g.writeAs(w, "gauge")
+}
+
+func newGaugeFunc(name, help string, collect func() map[string]float64, labels ...string) (g *gaugeFunc) {
+	g = &gaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	register(g)
+	return
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	values := g.collect()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %g\n", g.name, labelPairs(g.labels, k), values[k])
+	}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) (h *histogramVec) {
+	h = &histogramVec{name: name, help: help, labels: labels, buckets: buckets, counts: map[string][]uint64{}, sums: map[string]float64{}}
+	register(h)
+	return
+}
+
+// observe adds v to the histogram for the given label values
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	k := strings.Join(labelValues, labelSep)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	counts, ok := h.counts[k]
+	if !ok {
+		counts = make([]uint64, len(h.buckets)+1) // the last one is +Inf
+		h.counts[k] = counts
+	}
+	i := sort.SearchFloat64s(h.buckets, v) // the first bucket with v <= le
+	counts[i]++
+	h.sums[k] += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, k := range sortedKeys(h.sums) {
+		labels := append(append([]string{}, h.labels...), "le")
+		cumulative := uint64(0)
+		for i, count := range h.counts[k] {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = fmt.Sprintf("%g", h.buckets[i])
+			}
+			if len(h.labels) > 0 {
+				le = k + labelSep + le
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(labels, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, labelPairs(h.labels, k), h.sums[k])
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, k), cumulative)
+	}
+}
+
+// labelPairs formats the labels and the joined label values as {label="value",...}
+func labelPairs(labels []string, joinedValues string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	values := strings.Split(joinedValues, labelSep)
+	pairs := []string{}
+	for i, label := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label, values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// metricsService writes all the registered metrics in the Prometheus text format
+func metricsService(w http.ResponseWriter, r *http.Request) (err error) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+	return
+}
+
+// MDQ looks up key in the wrapped lmdq.MDQ and counts whether it was found in the cache
+func (c countingMd) MDQ(key string) (xp *goxml.Xp, err error) {
+	result := "miss"
+	if c.cached(key) {
+		result = "hit"
+	}
+	xp, err = c.mdq.MDQ(key)
+	mdqLookups.inc(c.mdq.Short, result)
+	return
+}
+
+func (c countingMd) cached(key string) bool {
+	if strings.HasPrefix(key, "{sha1}") {
+		key = key[6:]
+	} else if !mdqHexKey.MatchString(key) {
+		hash := sha1.Sum([]byte(key))
+		key = hex.EncodeToString(hash[:])
+	}
+	c.mdq.Lock.RLock()
+	defer c.mdq.Lock.RUnlock()
+	xp := c.mdq.Cache[key]
+	return xp != nil && xp.Valid(mdqCacheTTL)
+}
+
+// feedAges returns the age of the mddb of each metadata feed
+func feedAges() map[string]float64 {
+	stateLock.RLock()
+	feeds := config.MetadataFeeds
+	stateLock.RUnlock()
+	ages := map[string]float64{}
+	for _, feed := range feeds {
+		if fi, err := os.Stat(feed.Path); err == nil {
+			ages[feed.Path] = time.Since(fi.ModTime()).Seconds()
+		}
+	}
+	return ages
+}
+
+// timeSigning records the latency and errors of sign - the backend is hsm if privatekey is a goeleven hsm: key
+func timeSigning(privatekey []byte, sign func() error) (err error) {
+	backend := "software"
+	if strings.HasPrefix(string(privatekey), "hsm:") {
+		backend = "hsm"
+	}
+	start := time.Now()
+	if err = sign(); err != nil {
+		signingErrors.inc(backend)
+		return
+	}
+	signingDuration.observe(time.Since(start).Seconds(), backend)
+	return
+}
+
+// signResponse is gosaml.SignResponse with the signing recorded by timeSigning - the backend label comes from the key
+// gosaml.SignResponse looks up, gosaml caches the keys so the extra lookup is cheap
+func signResponse(response *goxml.Xp, elementQuery string, md *goxml.Xp, signingMethod string, signFor int) (err error) {
+	privatekey, _, err := gosaml.GetPrivateKey(md, "md:IDPSSODescriptor"+gosaml.SigningCertQuery)
+	if err != nil {
+		return
+	}
+	return timeSigning(privatekey, func() error {
+		return gosaml.SignResponse(response, elementQuery, md, signingMethod, signFor)
+	})
+}
+
+// cookieLabel returns the cookie label for the cookie size metric - the SSO2- cookies have the request id hash in their name
+func cookieLabel(name string) string {
+	if strings.HasPrefix(name, ssoCookieName) {
+		return ssoCookieName
+	}
+	return name
+}
@@ -0,0 +1,222 @@
+package wayfhybrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// rateLimitConf - the limits for a route in requests per minute per client IP and per requesting SP - 0 is no limit.
+	// The bursts defaults to the per minute limit.
+	rateLimitConf struct {
+		IPPerMinute, SPPerMinute int
+		IPBurst, SPBurst         int
+	}
+
+	// tokenBucket - the tokens left at last
+	tokenBucket struct {
+		tokens float64
+		last   time.Time
+	}
+
+	// limiter is a token bucket per key
+	limiter struct {
+		rate, burst float64
+		lock        sync.Mutex
+		buckets     map[string]*tokenBucket
+		pruned      time.Time
+	}
+
+	// routeLimiter - the limiters for a route - ip and sp are nil if there is no limit
+	routeLimiter struct {
+		route     string
+		ip, sp    *limiter
+		allowlist *rateLimitAllowlist
+	}
+
+	// rateLimitAllowlist - the client networks and SPs that are never limited
+	rateLimitAllowlist struct {
+		nets      []*net.IPNet
+		entityIDs map[string]bool
+	}
+
+	// rateLimitErr - by is ip or sp
+	rateLimitErr struct {
+		by         string
+		retryAfter time.Duration
+	}
+
+	routeLimiterKey struct{}
+)
+
+const (
+	rateLimitPruneInterval = time.Minute
+)
+
+var (
+	rateLimitNow = time.Now
+
+	rateLimitedTotal = newCounterVec("wayf_rate_limited_total", "Requests rejected by the rate limits by route and key - ip or sp", "route", "by")
+)
+
+func (e rateLimitErr) Error() string {
+	return fmt.Sprintf("rate limit per %s exceeded - retry after %s", e.by, e.retryAfter)
+}
+
+// newLimiter returns a limiter for perMinute requests - nil if perMinute is 0
+func newLimiter(perMinute, burst int) *limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = perMinute
+	}
+	return &limiter{rate: float64(perMinute) / 60, burst: float64(burst), buckets: map[string]*tokenBucket{}}
+}
+
+// allow takes a token from key's bucket - if it is empty the time until the next token is returned
+func (l *limiter) allow(key string) (ok bool, retryAfter time.Duration) {
+	now := rateLimitNow()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.pruned) > rateLimitPruneInterval {
+		l.prune(now)
+		l.pruned = now
+	}
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune removes the buckets that are full again - a full bucket is the same as no bucket
+func (l *limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// newRateLimitAllowlist parses Conf.RateLimitAllowlist - entries that are not addresses or CIDRs are SP entityIDs.
+// The test SPs are always allowed.
+func newRateLimitAllowlist(conf Conf) (al *rateLimitAllowlist, err error) {
+	al = &rateLimitAllowlist{entityIDs: map[string]bool{}}
+	cidrs := []string{}
+	for _, entry := range conf.RateLimitAllowlist {
+		if strings.Contains(entry, ":") && net.ParseIP(strings.SplitN(entry, "/", 2)[0]) == nil { // an url or urn
+			al.entityIDs[entry] = true
+			continue
+		}
+		cidrs = append(cidrs, entry)
+	}
+	if al.nets, err = parseCIDRs("RateLimitAllowlist", cidrs); err != nil {
+		return nil, err
+	}
+	names, hcs := hostConfs(conf)
+	for _, name := range names {
+		for _, testSP := range []string{hcs[name].TestSP, hcs[name].TestSP2} {
+			if testSP != "" {
+				al.entityIDs["https://"+hostOf(testSP)] = true
+			}
+		}
+	}
+	return
+}
+
+func (al *rateLimitAllowlist) allowsIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && netsContain(al.nets, parsed)
+}
+
+// newRateLimiters returns the routeLimiters for Conf.RateLimits by route name - the limiters in old with the same limits
+// are kept so a reload does not give everybody full buckets
+func newRateLimiters(conf Conf, old map[string]*routeLimiter) (limiters map[string]*routeLimiter, err error) {
+	allowlist, err := newRateLimitAllowlist(conf)
+	if err != nil {
+		return
+	}
+	known := map[string]bool{}
+	for _, rt := range routes(conf) {
+		known[rt.name] = true
+	}
+	limiters = map[string]*routeLimiter{}
+	for name, rl := range conf.RateLimits {
+		switch {
+		case !known[name]:
+			return nil, fmt.Errorf("RateLimits: unknown route %s", name)
+		case rl.IPPerMinute < 0 || rl.SPPerMinute < 0 || rl.IPBurst < 0 || rl.SPBurst < 0:
+			return nil, fmt.Errorf("RateLimits: negative limit for %s", name)
+		}
+		ip, sp := newLimiter(rl.IPPerMinute, rl.IPBurst), newLimiter(rl.SPPerMinute, rl.SPBurst)
+		if prev, ok := old[name]; ok {
+			ip, sp = sameLimiter(prev.ip, ip), sameLimiter(prev.sp, sp)
+		}
+		limiters[name] = &routeLimiter{route: name, ip: ip, sp: sp, allowlist: allowlist}
+	}
+	return
+}
+
+// sameLimiter returns old if it has the same rate and burst as l - otherwise l
+func sameLimiter(old, l *limiter) *limiter {
+	if old != nil && l != nil && old.rate == l.rate && old.burst == l.burst {
+		return old
+	}
+	return l
+}
+
+// wrap applies the per client IP limit to h - and makes the route's limiters available for limitSP
+func (rl *routeLimiter) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), routeLimiterKey{}, rl))
+		if ip := clientIP(r); rl.ip != nil && !rl.allowlist.allowsIP(ip) {
+			if ok, retryAfter := rl.ip.allow(ip); !ok {
+				err := rl.rejected("ip", retryAfter)
+				appHandler(func(w http.ResponseWriter, r *http.Request) error { return err }).ServeHTTP(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (rl *routeLimiter) rejected(by string, retryAfter time.Duration) error {
+	rateLimitedTotal.inc(rl.route, by)
+	return newError(rateLimitedError, rateLimitErr{by: by, retryAfter: retryAfter})
+}
+
+// limitSP applies the per SP limit of r's route - allowlisted SPs are still limited per client IP by wrap, which runs before the SP is known
+func limitSP(r *http.Request, entityID string) error {
+	rl, ok := r.Context().Value(routeLimiterKey{}).(*routeLimiter)
+	if !ok || rl.sp == nil || rl.allowlist.entityIDs[entityID] {
+		return nil
+	}
+	if ok, retryAfter := rl.sp.allow(entityID); !ok {
+		return rl.rejected("sp", retryAfter)
+	}
+	return nil
+}
+
+// setRetryAfter sets the Retry-After header if err is a rateLimitErr - in whole seconds rounded up
+func setRetryAfter(w http.ResponseWriter, err error) {
+	var rle rateLimitErr
+	if errors.As(err, &rle) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rle.retryAfter.Seconds()))))
+	}
+}
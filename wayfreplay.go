@@ -0,0 +1,156 @@
+package wayfhybrid
+
+import (
+	"database/sql" // the sqlite3 driver is registered by lmdq
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wayf-dk/gosaml"
+	"github.com/wayf-dk/goxml"
+)
+
+type (
+	// replayCache remembers the one-time values until they expire - use returns false if key is already used
+	replayCache interface {
+		use(key string, expires time.Time) (bool, error)
+	}
+
+	// memoryReplayCache is the in-process replayCache - each node only knows about the responses it has seen itself
+	memoryReplayCache struct {
+		lock   sync.Mutex
+		used   map[string]time.Time
+		pruned time.Time
+	}
+
+	// sqliteReplayCache is a replayCache that can be shared by the nodes on a host or a shared filesystem
+	sqliteReplayCache struct {
+		db     *sql.DB
+		lock   sync.Mutex
+		pruned time.Time
+	}
+)
+
+const (
+	// replayMaxTTL bounds how long a value is remembered whatever the assertion says
+	replayMaxTTL = 24 * time.Hour
+)
+
+var (
+	replays replayCache = newMemoryReplayCache()
+
+	replayNow = time.Now
+
+	replaysTotal = newCounterVec("wayf_replays_total", "Responses rejected because the InResponseTo or the Assertion ID was already used", "kind")
+)
+
+// newReplayCache returns the replayCache for Conf.ReplayCache - memory (the default) or sqlite in Conf.ReplayCacheDB
+func newReplayCache(conf Conf) (replayCache, error) {
+	switch conf.ReplayCache {
+	case "", "memory":
+		return newMemoryReplayCache(), nil
+	case "sqlite":
+		return newSQLiteReplayCache(conf.ReplayCacheDB)
+	}
+	return nil, fmt.Errorf("ReplayCache: unknown cache %q", conf.ReplayCache)
+}
+
+// checkReplay marks the InResponseTo and Assertion ID of response as used - a second use is a replayError.
+// They are remembered until the assertion's NotOnOrAfter - but at least the lifetime of the request.
+func checkReplay(r *http.Request, response *goxml.Xp) error {
+	now := replayNow()
+	expires := now.Add(authnRequestTTL * time.Second)
+	for _, xpath := range []string{"saml:Assertion/saml:Subject/saml:SubjectConfirmation/saml:SubjectConfirmationData/@NotOnOrAfter", "saml:Assertion/saml:Conditions/@NotOnOrAfter"} {
+		if notOnOrAfter, err := time.Parse(gosaml.XsDateTime, response.Query1(nil, xpath)); err == nil && notOnOrAfter.After(expires) {
+			expires = notOnOrAfter
+		}
+	}
+	if expires.After(now.Add(replayMaxTTL)) {
+		expires = now.Add(replayMaxTTL)
+	}
+
+	issuer := response.Query1(nil, "saml:Issuer")
+	for _, v := range []struct{ kind, value string }{
+		{"InResponseTo", response.Query1(nil, "@InResponseTo")},
+		{"Assertion ID", response.Query1(nil, "saml:Assertion/@ID")},
+	} {
+		if v.value == "" {
+			continue
+		}
+		ok, err := replays.use(v.kind+"|"+issuer+"|"+v.value, expires)
+		if err != nil {
+			return goxml.Wrap(err)
+		}
+		if !ok {
+			replaysTotal.inc(v.kind)
+			logger.event(r, "replay", map[string]string{"kind": v.kind, "value": v.value, "issuer": issuer})
+			return newError(replayError, fmt.Errorf("replay: %s %s from %s is already used", v.kind, v.value, issuer))
+		}
+	}
+	return nil
+}
+
+func newMemoryReplayCache() *memoryReplayCache {
+	return &memoryReplayCache{used: map[string]time.Time{}}
+}
+
+func (c *memoryReplayCache) use(key string, expires time.Time) (bool, error) {
+	now := replayNow()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now.Sub(c.pruned) > sessionPruneInterval {
+		for k, exp := range c.used {
+			if !now.Before(exp) {
+				delete(c.used, k)
+			}
+		}
+		c.pruned = now
+	}
+	if exp, ok := c.used[key]; ok && now.Before(exp) {
+		return false, nil
+	}
+	c.used[key] = expires
+	return true, nil
+}
+
+// newSQLiteReplayCache opens - and if needed creates - the replays table in the sqlite database at path
+func newSQLiteReplayCache(path string) (*sqliteReplayCache, error) {
+	if path == "" {
+		return nil, errors.New("ReplayCacheDB: no path for the sqlite replay cache")
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("ReplayCacheDB: %s", err)
+	}
+	if _, err = db.Exec(`create table if not exists replays (key text primary key, expires integer)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ReplayCacheDB: %s", err)
+	}
+	return &sqliteReplayCache{db: db}, nil
+}
+
+// use deletes key if it has expired and then tries to insert it - if no row is inserted another node or request has used it
+func (c *sqliteReplayCache) use(key string, expires time.Time) (ok bool, err error) {
+	now := replayNow()
+	c.lock.Lock()
+	prune := now.Sub(c.pruned) > sessionPruneInterval
+	if prune {
+		c.pruned = now
+	}
+	c.lock.Unlock()
+	if prune {
+		if _, err = c.db.Exec(`delete from replays where expires <= ?`, now.UnixNano()); err != nil {
+			return
+		}
+	} else if _, err = c.db.Exec(`delete from replays where key = ? and expires <= ?`, key, now.UnixNano()); err != nil {
+		return
+	}
+	res, err := c.db.Exec(`insert or ignore into replays (key, expires) values (?, ?)`, key, expires.UnixNano())
+	if err != nil {
+		return
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
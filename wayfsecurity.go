@@ -0,0 +1,107 @@
+package wayfhybrid
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/wayf-dk/goxml"
+)
+
+var (
+	// defaultSecurityHeaders are added to all responses from the front listener - Conf.SecurityHeaders overrides them by name,
+	// an empty value removes the header. Headers that only suit some responses, eg. a Content-Security-Policy that must allow
+	// the post forms to submit to any SP, are opt-in - set them in Conf.SecurityHeaders.
+	defaultSecurityHeaders = map[string]string{
+		"Strict-Transport-Security": "max-age=31536000",
+		"Referrer-Policy":           "strict-origin",
+		"X-Content-Type-Options":    "nosniff",
+	}
+
+	// corsLocations - the SP endpoints that are allowed as CORS origins
+	corsLocations = "md:SPSSODescriptor/md:AssertionConsumerService/@Location | md:SPSSODescriptor/md:Extensions/idpdisc:DiscoveryResponse/@Location"
+)
+
+// securityHeaders returns the security header policy for conf
+func securityHeaders(conf Conf) (headers map[string]string) {
+	headers = map[string]string{}
+	for name, value := range defaultSecurityHeaders {
+		headers[name] = value
+	}
+	for name, value := range conf.SecurityHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if value == "" {
+			delete(headers, name)
+			continue
+		}
+		headers[name] = value
+	}
+	return
+}
+
+// withSecurityHeaders adds the security header policy to all responses from h - handlers can still override a header
+func withSecurityHeaders(conf Conf, h http.Handler) http.Handler {
+	headers := securityHeaders(conf)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkCORSOrigins checks that Conf.CORSOrigins are origins - https://host[:port] with an optional *. prefix on the host
+func checkCORSOrigins(conf Conf) error {
+	for _, origin := range conf.CORSOrigins {
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("CORSOrigins: %q is not an origin", origin)
+		}
+	}
+	return nil
+}
+
+// allowOrigin sets the CORS headers if the Origin of r is allowed by Conf.CORSOrigins, is in the deployment's domain or
+// is the origin of one of md's SP endpoints. md can be nil. The Origin is never reflected if none of them matches.
+func allowOrigin(w http.ResponseWriter, r *http.Request, md *goxml.Xp) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		return
+	}
+	w.Header().Set("Vary", "Origin")
+	if !originAllowed(r, origin, md) {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+}
+
+func originAllowed(r *http.Request, origin string, md *goxml.Xp) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.Path != "" {
+		return false
+	}
+	for _, allowed := range stateFor(r).config.CORSOrigins {
+		if allowed == origin {
+			return true
+		}
+		if i := strings.Index(allowed, "://*."); i >= 0 && strings.HasPrefix(origin, allowed[:i+3]) && strings.HasSuffix(origin, allowed[i+4:]) {
+			return true
+		}
+	}
+	if d := deploymentFor(r); d != nil && d.Domain != "" {
+		domain := strings.TrimPrefix(d.Domain, ".")
+		if host := u.Hostname(); host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	if md != nil {
+		for _, location := range md.QueryMulti(nil, corsLocations) {
+			if l, err := url.Parse(location); err == nil && l.Scheme+"://"+l.Host == origin {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package wayfhybrid
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultShutdownGracePeriod = 30 * time.Second
+	defaultReadHeaderTimeout   = 10 * time.Second
+	defaultIdleTimeout         = 120 * time.Second
+	certCheckInterval          = 10 * time.Second
+)
+
+type (
+	// certReloader serves the certificate from certFile and keyFile and reloads it when either file changes
+	certReloader struct {
+		certFile, keyFile string
+		lock              sync.Mutex
+		cert              *tls.Certificate
+		modTime           time.Time
+		checked           time.Time
+	}
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+	tlsCurves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+
+	// ready is 1 when we accept new logins - it is cleared when we start draining
+	ready int32
+)
+
+func setReady(ok bool) {
+	var v int32
+	if ok {
+		v = 1
+	}
+	atomic.StoreInt32(&ready, v)
+}
+
+func isReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// serve runs listen for srv and reports to errc if it stops for any other reason than a shutdown
+func serve(srv *http.Server, errc chan<- error, listen func() error) {
+	if err := listen(); err != http.ErrServerClosed {
+		errc <- fmt.Errorf("%s: %s", srv.Addr, err)
+	}
+}
+
+// shutdown marks us as not ready, waits delay to let the load balancer notice, stops the servers from
+// accepting new connections and waits - at most gracePeriod - for the requests in flight to finish
+func shutdown(delay, gracePeriod time.Duration, servers ...*http.Server) (err error) {
+	setReady(false)
+	time.Sleep(delay)
+	if gracePeriod <= 0 {
+		gracePeriod = defaultShutdownGracePeriod
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if err := srv.Shutdown(ctx); err != nil {
+				errc <- fmt.Errorf("%s: shutdown: %s", srv.Addr, err)
+				return
+			}
+			errc <- nil
+		}(srv)
+	}
+	for range servers {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// newFrontServer makes the https server for the front listener with the timeouts and tls settings from conf
+func newFrontServer(conf Conf, handler http.Handler) (srv *http.Server, err error) {
+	tlsConfig, err := newTLSConfig(conf)
+	if err != nil {
+		return
+	}
+	cr := &certReloader{certFile: conf.HTTPSCert, keyFile: conf.HTTPSKey}
+	if _, err = cr.GetCertificate(nil); err != nil {
+		return
+	}
+	tlsConfig.GetCertificate = cr.GetCertificate
+
+	srv = &http.Server{
+		Addr:              conf.Intf,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       conf.ReadTimeout,
+		ReadHeaderTimeout: conf.ReadHeaderTimeout,
+		WriteTimeout:      conf.WriteTimeout,
+		IdleTimeout:       conf.IdleTimeout,
+	}
+	if srv.ReadHeaderTimeout == 0 {
+		srv.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if srv.IdleTimeout == 0 {
+		srv.IdleTimeout = defaultIdleTimeout
+	}
+	return
+}
+
+// newAdminServer makes the server for the internal admin listener - on AdminIntf or port 9000 on the front interface.
+// If AdminClientCA is set it uses https and asks for a client certificate signed by it.
+func newAdminServer(conf Conf, handler http.Handler) (srv *http.Server, err error) {
+	srv = &http.Server{
+		Addr:              conf.AdminIntf,
+		Handler:           handler,
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+		IdleTimeout:       defaultIdleTimeout,
+	}
+	if srv.Addr == "" {
+		srv.Addr = regexp.MustCompile(`^(.*:).*$`).ReplaceAllString(conf.Intf, "$1") + "9000"
+	}
+	if conf.AdminClientCA == "" {
+		return
+	}
+	pem, err := ioutil.ReadFile(conf.AdminClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("AdminClientCA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("AdminClientCA: no certificates found in %s", conf.AdminClientCA)
+	}
+	if srv.TLSConfig, err = newTLSConfig(conf); err != nil {
+		return nil, err
+	}
+	cr := &certReloader{certFile: conf.HTTPSCert, keyFile: conf.HTTPSKey}
+	if _, err = cr.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	srv.TLSConfig.GetCertificate = cr.GetCertificate
+	srv.TLSConfig.ClientCAs = pool
+	srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven // the bearer token is still accepted
+	return
+}
+
+// newTLSConfig makes a tls.Config from the TLS settings in conf - empty settings leaves Go's defaults, except for the minimum version which defaults to 1.2
+func newTLSConfig(conf Conf) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if conf.TLSMinVersion != "" {
+		v, ok := tlsVersions[conf.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("TLSMinVersion: unknown version %s", conf.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+	for _, name := range conf.TLSCurves {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("TLSCurves: unknown curve %s", name)
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+	suites := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range conf.TLSCipherSuites {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("TLSCipherSuites: unknown cipher suite %s", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	return
+}
+
+// GetCertificate returns the current certificate - reloaded if the files has changed since it was loaded.
+// If the reload fails - eg. if only one of the files has been replaced yet - the previous certificate is used.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if cr.cert != nil && time.Since(cr.checked) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.checked = time.Now()
+	modTime := time.Time{}
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			if cr.cert != nil {
+				log.Printf("certReloader: %s - keeping current certificate\n", err)
+				return cr.cert, nil
+			}
+			return nil, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if cr.cert != nil && modTime.Equal(cr.modTime) {
+		return cr.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		if cr.cert != nil {
+			log.Printf("certReloader: %s - keeping current certificate\n", err)
+			return cr.cert, nil
+		}
+		return nil, err
+	}
+	if cr.cert != nil {
+		log.Printf("certReloader: reloaded %s and %s\n", cr.certFile, cr.keyFile)
+	}
+	cr.cert, cr.modTime = &cert, modTime
+	return cr.cert, nil
+}
@@ -0,0 +1,216 @@
+package wayfhybrid
+
+import (
+	"database/sql" // the sqlite3 driver is registered by lmdq
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+type (
+	// serverSession keeps the session values in a sessionStore - the browser only gets a random session id in a cookie
+	serverSession struct {
+		store sessionStore
+	}
+
+	// sessionStore - a key value store with expiry for serverSession
+	sessionStore interface {
+		put(key string, data []byte, expires time.Time) error
+		get(key string) ([]byte, error) // errSessionNotFound if the key is missing or expired
+		del(key string) error
+	}
+
+	// memoryStore is a sessionStore for tests and single nodes - the values are lost on restart
+	memoryStore struct {
+		lock   sync.Mutex
+		values map[string]memoryValue
+		pruned time.Time
+	}
+
+	memoryValue struct {
+		data    []byte
+		expires time.Time
+	}
+
+	// sqliteStore is a sessionStore that can be shared by the nodes on a host or a shared filesystem
+	sqliteStore struct {
+		db     *sql.DB
+		lock   sync.Mutex
+		pruned time.Time
+	}
+)
+
+const (
+	sessionIDCookieName  = "wayf_session"
+	sessionPruneInterval = time.Minute
+)
+
+var (
+	sessionNow = time.Now
+
+	errSessionNotFound = errors.New("session: value not found")
+	validSessionID     = regexp.MustCompile(`^[a-f0-9]{32}$`)
+)
+
+// newSession returns the HybridSession for Conf.SessionStore - cookie (the default), memory or sqlite.
+// The sqlite store uses Conf.SessionDB which can be an uri ie. file:/var/run/wayf/sessions.db?_busy_timeout=5000&_journal_mode=WAL
+func newSession(conf Conf) (HybridSession, error) {
+	switch conf.SessionStore {
+	case "", "cookie":
+		return wayfHybridSession{}, nil
+	case "memory":
+		return serverSession{store: newMemoryStore()}, nil
+	case "sqlite":
+		store, err := newSQLiteStore(conf.SessionDB)
+		if err != nil {
+			return nil, err
+		}
+		return serverSession{store: store}, nil
+	}
+	return nil, fmt.Errorf("SessionStore: unknown store %q", conf.SessionStore)
+}
+
+// sessionParams returns the key ring and max age in seconds for the session value id
+func sessionParams(r *http.Request, id string) (*cookieKeyRing, int) {
+	st := stateFor(r)
+	switch id {
+	case sloCookieName:
+		return st.sloInfoCookie, sloInfoTTL
+	case hubSSOCookieName:
+		return st.sloInfoCookie, int(st.config.HubSSOTTL / time.Second)
+	}
+	return st.authnRequestCookie, authnRequestTTL
+}
+
+// Set saves data as id in r's session - a new session is started if r does not have one
+func (s serverSession) Set(w http.ResponseWriter, r *http.Request, id string, data []byte) error {
+	_, maxAge := sessionParams(r, id)
+	return s.store.put(s.sessionID(w, r, true)+"|"+id, data, sessionNow().Add(time.Duration(maxAge)*time.Second))
+}
+
+// Get returns id from r's session
+func (s serverSession) Get(w http.ResponseWriter, r *http.Request, id string) ([]byte, error) {
+	sid := s.sessionID(w, r, false)
+	if sid == "" {
+		return nil, errSessionNotFound
+	}
+	return s.store.get(sid + "|" + id)
+}
+
+// Del deletes id from r's session
+func (s serverSession) Del(w http.ResponseWriter, r *http.Request, id string) error {
+	if sid := s.sessionID(w, r, false); sid != "" {
+		return s.store.del(sid + "|" + id)
+	}
+	return nil
+}
+
+// GetDel returns and deletes id from r's session
+func (s serverSession) GetDel(w http.ResponseWriter, r *http.Request, id string) (data []byte, err error) {
+	if data, err = s.Get(w, r, id); err != nil {
+		return
+	}
+	err = s.Del(w, r, id)
+	return
+}
+
+// sessionID returns the session id from r - if create is true and r does not have one a new one is made, sent to the browser
+// and added to r so later calls for the same request sees it
+func (s serverSession) sessionID(w http.ResponseWriter, r *http.Request, create bool) string {
+	if c, err := r.Cookie(sessionIDCookieName); err == nil && validSessionID.MatchString(c.Value) {
+		return c.Value
+	}
+	if !create {
+		return ""
+	}
+	sid := newRequestID() + newRequestID()
+	setCookie(w, r, sessionIDCookieName, sid, sloInfoTTL)
+	r.AddCookie(&http.Cookie{Name: sessionIDCookieName, Value: sid})
+	return sid
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{values: map[string]memoryValue{}}
+}
+
+func (m *memoryStore) put(key string, data []byte, expires time.Time) error {
+	now := sessionNow()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if now.Sub(m.pruned) > sessionPruneInterval {
+		for k, v := range m.values {
+			if !now.Before(v.expires) {
+				delete(m.values, k)
+			}
+		}
+		m.pruned = now
+	}
+	m.values[key] = memoryValue{data: append([]byte{}, data...), expires: expires}
+	return nil
+}
+
+func (m *memoryStore) get(key string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.values[key]
+	if !ok || !sessionNow().Before(v.expires) {
+		return nil, errSessionNotFound
+	}
+	return append([]byte{}, v.data...), nil
+}
+
+func (m *memoryStore) del(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+// newSQLiteStore opens - and if needed creates - the sessions table in the sqlite database at path
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	if path == "" {
+		return nil, errors.New("SessionDB: no path for the sqlite session store")
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("SessionDB: %s", err)
+	}
+	if _, err = db.Exec(`create table if not exists sessions (key text primary key, data blob, expires integer)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("SessionDB: %s", err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) put(key string, data []byte, expires time.Time) (err error) {
+	now := sessionNow()
+	s.lock.Lock()
+	prune := now.Sub(s.pruned) > sessionPruneInterval
+	if prune {
+		s.pruned = now
+	}
+	s.lock.Unlock()
+	if prune {
+		if _, err = s.db.Exec(`delete from sessions where expires <= ?`, now.UnixNano()); err != nil {
+			return
+		}
+	}
+	_, err = s.db.Exec(`insert or replace into sessions (key, data, expires) values (?, ?, ?)`, key, data, expires.UnixNano())
+	return
+}
+
+func (s *sqliteStore) get(key string) (data []byte, err error) {
+	err = s.db.QueryRow(`select data from sessions where key = ? and expires > ?`, key, sessionNow().UnixNano()).Scan(&data)
+	if err == sql.ErrNoRows {
+		err = errSessionNotFound
+	}
+	return
+}
+
+func (s *sqliteStore) del(key string) (err error) {
+	_, err = s.db.Exec(`delete from sessions where key = ?`, key)
+	return
+}
@@ -0,0 +1,169 @@
+package wayfhybrid
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/wayf-dk/gosaml"
+)
+
+const (
+	// cookiePartSize leaves room for the name and the attributes within the 4096 bytes browsers allow for a cookie
+	cookiePartSize = 3800
+	// maxCookieParts - the whole Cookie header must also stay below the proxies' limits - pt. 8k for nginx
+	maxCookieParts = 2
+
+	// sloCompressed marks a deflated SLOInfoList - gosaml's Marshal always starts with a lower case letter
+	sloCompressed = 1
+	// sloMaxEntries - the oldest idle entries are evicted when there are more
+	sloMaxEntries = 32
+)
+
+var (
+	errCookieTooBig = errors.New("cookie: value too big for the cookie budget")
+
+	// sloFallback keeps the SLOInfoList server side when it is too big for the cookies - see Conf.SLOFallback.
+	// If it is nil the oldest idle entries are evicted until the list fits.
+	sloFallback HybridSession
+
+	sloOverflows = newCounterVec("wayf_slo_overflows_total", "SLO info that did not fit in the cookies by action - evicted or server", "action")
+)
+
+// newSLOFallback returns the HybridSession for Conf.SLOFallback - none (the default), memory or sqlite in Conf.SessionDB.
+// It is not needed if the session itself is server side.
+func newSLOFallback(conf Conf) (HybridSession, error) {
+	switch conf.SLOFallback {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		return serverSession{store: newMemoryStore()}, nil
+	case "sqlite":
+		store, err := newSQLiteStore(conf.SessionDB)
+		if err != nil {
+			return nil, err
+		}
+		return serverSession{store: store}, nil
+	}
+	return nil, fmt.Errorf("SLOFallback: unknown store %q", conf.SLOFallback)
+}
+
+// loadSLOInfo returns the SLOInfoList from the session - or from the fallback if it has overflowed
+func loadSLOInfo(w http.ResponseWriter, r *http.Request) (sil *gosaml.SLOInfoList) {
+	sil = &gosaml.SLOInfoList{}
+	data, _ := session.Get(w, r, sloCookieName)
+	if len(data) == 0 && sloFallback != nil {
+		data, _ = sloFallback.Get(w, r, sloCookieName)
+	}
+	if data, err := decodeSLOInfo(data); err == nil {
+		sil.Unmarshal(data)
+	}
+	return
+}
+
+// saveSLOInfo saves sil in the session - if it does not fit it goes to the fallback or the oldest idle entries are evicted until it fits
+func saveSLOInfo(w http.ResponseWriter, r *http.Request, sil *gosaml.SLOInfoList) (err error) {
+	evictSLOInfo(sil, sloMaxEntries)
+	for {
+		if err = session.Set(w, r, sloCookieName, encodeSLOInfo(sil)); err != errCookieTooBig {
+			if err == nil && sloFallback != nil {
+				sloFallback.Del(w, r, sloCookieName)
+			}
+			return
+		}
+		if sloFallback != nil {
+			sloOverflows.inc("server")
+			session.Del(w, r, sloCookieName)
+			return sloFallback.Set(w, r, sloCookieName, encodeSLOInfo(sil))
+		}
+		sloOverflows.inc("evicted")
+		if !evictSLOInfo(sil, len(*sil)-1) {
+			return
+		}
+	}
+}
+
+// clearSLOInfo deletes the SLOInfoList from the session and the fallback
+func clearSLOInfo(w http.ResponseWriter, r *http.Request) {
+	session.Del(w, r, sloCookieName)
+	if sloFallback != nil {
+		sloFallback.Del(w, r, sloCookieName)
+	}
+}
+
+// evictSLOInfo removes the oldest idle entries - the newest are first - until sil has at most max entries.
+// Entries taking part in a logout are kept. Returns false if nothing could be removed.
+func evictSLOInfo(sil *gosaml.SLOInfoList, max int) (evicted bool) {
+	for i := len(*sil) - 1; i >= 0 && len(*sil) > max; i-- {
+		if slo := (*sil)[i]; slo.ID == "" && slo.SLOStatus == 0 {
+			*sil = append((*sil)[:i], (*sil)[i+1:]...)
+			evicted = true
+		}
+	}
+	return
+}
+
+// encodeSLOInfo deflates gosaml's marshalled SLOInfoList - the entityIDs are repeated a lot
+func encodeSLOInfo(sil *gosaml.SLOInfoList) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(sloCompressed)
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write(sil.Marshal())
+	fw.Close()
+	return buf.Bytes()
+}
+
+// decodeSLOInfo inflates data if it is compressed - the SLO cookies from before are not
+func decodeSLOInfo(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != sloCompressed {
+		return data, nil
+	}
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(data[1:])))
+}
+
+// splitCookie splits value in parts of cookiePartSize - the first part is prefixed with the number of parts and a * if there are more than one
+func splitCookie(value string) (parts []string) {
+	for len(value) > cookiePartSize {
+		parts = append(parts, value[:cookiePartSize])
+		value = value[cookiePartSize:]
+	}
+	parts = append(parts, value)
+	if len(parts) > 1 {
+		parts[0] = strconv.Itoa(len(parts)) + "*" + parts[0]
+	}
+	return
+}
+
+// joinCookie joins the parts of a split cookie - value is the value of the first part
+func joinCookie(r *http.Request, id, value string) (string, error) {
+	i := strings.Index(value, "*")
+	if i < 0 {
+		return value, nil
+	}
+	n, err := strconv.Atoi(value[:i])
+	if err != nil || n < 2 || n > maxCookieParts {
+		return "", fmt.Errorf("cookie: %s has an invalid number of parts", id)
+	}
+	parts := []string{value[i+1:]}
+	for p := 1; p < n; p++ {
+		c, err := r.Cookie(cookiePartName(id, p))
+		if err != nil {
+			return "", fmt.Errorf("cookie: %s part %d is missing", id, p+1)
+		}
+		parts = append(parts, c.Value)
+	}
+	return strings.Join(parts, ""), nil
+}
+
+// cookiePartName returns the name of part i of cookie id - the first part keeps the name
+func cookiePartName(id string, i int) string {
+	if i == 0 {
+		return id
+	}
+	return id + "-" + strconv.Itoa(i+1)
+}